@@ -0,0 +1,149 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gobwas/ws"
+)
+
+// UpgradeChecker is called before an upgrade request is answered. Returning an
+// error rejects the request, with the status and headers of a *RejectError or
+// with 403 Forbidden otherwise.
+type UpgradeChecker func(request *http.Request) (UpgradeAccept, error)
+
+// UpgradeAccept describes an accepted upgrade request.
+type UpgradeAccept struct {
+	// Header is added to the handshake response.
+	Header http.Header
+	// Attachment is associated with the connection, see Transport.Attachment.
+	Attachment interface{}
+}
+
+// RejectError rejects an upgrade request with an HTTP response.
+type RejectError struct {
+	Status int
+	Header http.Header
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	if "" == e.Reason {
+		return "websocket: upgrade rejected: " + http.StatusText(e.Status)
+	}
+	return "websocket: upgrade rejected: " + e.Reason
+}
+
+// errOriginNotAllowed rejects requests from origins missing in Options.AllowedOrigins.
+var errOriginNotAllowed = &RejectError{Status: http.StatusForbidden, Reason: "origin not allowed"}
+
+// Attachment returns the attachment assigned by Options.CheckUpgrade, nil on the client side.
+func (t *websocketTransport) Attachment() interface{} {
+	return t.attachment
+}
+
+// prepareUpgrade checks the request with Options.AllowedOrigins and
+// Options.CheckUpgrade and returns the upgrader for it, which negotiates the
+// subprotocol and compression of this request. A rejected request is
+// answered before the error is returned.
+func prepareUpgrade(upgrader ws.HTTPUpgrader, options *Options, writer http.ResponseWriter, request *http.Request) (ws.HTTPUpgrader, interface{}, error) {
+
+	var accept UpgradeAccept
+	var err error
+
+	if !originAllowed(options.AllowedOrigins, request) {
+		err = errOriginNotAllowed
+	} else if nil != options.CheckUpgrade {
+		accept, err = options.CheckUpgrade(request)
+	}
+
+	if nil != err {
+		rejectUpgrade(writer, err)
+		return upgrader, nil, err
+	}
+
+	upgrader = protocolUpgrader(upgrader, options, request)
+
+	if 0 == upgrader.Timeout {
+		upgrader.Timeout = options.HandshakeTimeout
+	}
+
+	if options.CompressEnabled && nil == upgrader.Negotiate {
+		upgrader.Negotiate = (&deflateNegotiator{params: options.deflateParameters()}).Negotiate
+	}
+	if nil != options.CompressFilter && !options.CompressFilter(request) {
+		upgrader.Negotiate = nil
+	}
+
+	if len(accept.Header) > 0 {
+		header := upgrader.Header.Clone()
+		if nil == header {
+			header = make(http.Header, len(accept.Header))
+		}
+		for key, values := range accept.Header {
+			for _, value := range values {
+				header.Add(key, value)
+			}
+		}
+		upgrader.Header = header
+	}
+
+	return upgrader, accept.Attachment, nil
+}
+
+func rejectUpgrade(writer http.ResponseWriter, err error) {
+
+	status, reason := http.StatusForbidden, http.StatusText(http.StatusForbidden)
+
+	var reject *RejectError
+	if errors.As(err, &reject) {
+		if 0 != reject.Status {
+			status, reason = reject.Status, http.StatusText(reject.Status)
+		}
+		if "" != reject.Reason {
+			reason = reject.Reason
+		}
+		for key, values := range reject.Header {
+			writer.Header()[key] = values
+		}
+	}
+
+	http.Error(writer, reason, status)
+}
+
+// originAllowed reports whether the Origin of the request is listed in origins,
+// requests without Origin are sent by non-browser clients and always allowed.
+func originAllowed(origins []string, request *http.Request) bool {
+	if 0 == len(origins) {
+		return true
+	}
+
+	origin := request.Header.Get("Origin")
+	if "" == origin {
+		return true
+	}
+
+	for _, allowed := range origins {
+		if "*" == allowed || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func authorizeOptions() *Options {
+	opts := *DefaultOptions
+	opts.AllowedOrigins = []string{"https://app.example.com"}
+	opts.CheckUpgrade = func(request *http.Request) (UpgradeAccept, error) {
+		if request.Header.Get("Authorization") != "Bearer secret" {
+			return UpgradeAccept{}, &RejectError{
+				Status: http.StatusUnauthorized,
+				Header: http.Header{"Www-Authenticate": {"Bearer"}},
+			}
+		}
+		return UpgradeAccept{
+			Header:     http.Header{"X-Session": {"s1"}},
+			Attachment: "user-1",
+		}, nil
+	}
+	return &opts
+}
+
+func upgradeRequest(t *testing.T, url string, header http.Header) *http.Response {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("new request error: %v", err)
+	}
+	request.Header = header
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatalf("round trip error: %v", err)
+	}
+	t.Cleanup(func() { _ = response.Body.Close() })
+	return response
+}
+
+func TestCheckUpgrade_Reject(t *testing.T) {
+	acceptor := listenWebsocket(t, authorizeOptions())
+	url := "http://" + acceptor.httpServer.Addr + "/ws"
+
+	response := upgradeRequest(t, url, http.Header{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	if response.Header.Get("Www-Authenticate") != "Bearer" {
+		t.Fatalf("missing rejection header: %v", response.Header)
+	}
+
+	response = upgradeRequest(t, url, http.Header{
+		"Authorization": {"Bearer secret"},
+		"Origin":        {"https://evil.example.com"},
+	})
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status for foreign origin: %d", response.StatusCode)
+	}
+}
+
+func TestCheckUpgrade_Accept(t *testing.T) {
+	acceptor := listenWebsocket(t, authorizeOptions())
+
+	response := upgradeRequest(t, "http://"+acceptor.httpServer.Addr+"/ws", http.Header{
+		"Authorization": {"Bearer secret"},
+		"Origin":        {"https://app.example.com"},
+	})
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	if response.Header.Get("X-Session") != "s1" {
+		t.Fatalf("missing accept header: %v", response.Header)
+	}
+
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	if got := server.(Transport).Attachment(); got != "user-1" {
+		t.Fatalf("unexpected attachment: %v", got)
+	}
+}
+
+func TestCheckUpgrade_Dial(t *testing.T) {
+	acceptor := listenWebsocket(t, authorizeOptions())
+
+	clientOpts := *DefaultOptions
+	if _, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", &clientOpts); err == nil {
+		t.Fatalf("expected unauthorized dial to fail")
+	}
+
+	clientOpts.Dialer.Header = ws.HandshakeHeaderHTTP(http.Header{"Authorization": {"Bearer secret"}})
+	if _, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", &clientOpts); err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-netty/go-netty-transport/websocket/internal/wsutils"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+const defaultCloseTimeout = 3 * time.Second
+
+// closeWriteTimeout bounds the close frame write of an aborted connection, so a
+// stuck peer can't block the close.
+const closeWriteTimeout = time.Second
+
+// ErrMessageTooBig is returned by Read when a message exceeds Options.MaxMessageSize
+// or Options.MaxDecompressedSize.
+var ErrMessageTooBig = wsutils.ErrMessageTooBig
+
+// CloseError is returned by Read when the peer closed the connection, it carries
+// the status code and reason of the received close frame.
+type CloseError struct {
+	Code   ws.StatusCode
+	Reason string
+}
+
+func (e CloseError) Error() string {
+	if "" == e.Reason {
+		return fmt.Sprintf("websocket: closed with status %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: closed with status %d: %s", e.Code, e.Reason)
+}
+
+// IsCloseError reports whether err is a CloseError with one of the given codes,
+// or with any code if none is given.
+func IsCloseError(err error, codes ...ws.StatusCode) bool {
+	var ce CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+
+	if 0 == len(codes) {
+		return true
+	}
+
+	for _, code := range codes {
+		if ce.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func wrapCloseError(err error) error {
+	var ce wsutil.ClosedError
+	if errors.As(err, &ce) {
+		return CloseError{Code: ce.Code, Reason: ce.Reason}
+	}
+	return err
+}
+
+// GracefulClose sends a close frame with the given code and reason and returns
+// without waiting for the peer's close frame.
+//
+// The peer's close frame is received by the read loop of the channel, which runs
+// the handlers, so waiting for it here would block a handler calling GracefulClose
+// until the timeout. The read loop closes the transport when the close frame
+// arrives instead, and a timer closes it after Options.CloseTimeout if it doesn't.
+func (t *websocketTransport) GracefulClose(code int, reason string) error {
+
+	timeout := t.options.CloseTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+
+	timer := time.AfterFunc(timeout, func() { _ = t.Close() })
+	if !t.closeTimer.CompareAndSwap(nil, timer) {
+		// already closing
+		timer.Stop()
+	}
+
+	if err := t.WriteClose(code, reason); nil != err {
+		_ = t.Close()
+		return err
+	}
+
+	select {
+	case <-t.closeReceived:
+		// the peer closed first
+		return t.Close()
+	default:
+	}
+	return nil
+}
+
+// abort sends a close frame with the given code and reason without waiting for
+// the peer's close frame, then closes the transport.
+func (t *websocketTransport) abort(code ws.StatusCode, reason string) {
+	_ = t.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	_ = t.WriteClose(int(code), reason)
+	_ = t.Close()
+}
+
+// onClose is called by the control handler when the peer's close frame arrives,
+// the frame is echoed unless we started the close handshake.
+func (t *websocketTransport) onClose(code ws.StatusCode, reason string) bool {
+	t.closeOnce.Do(func() { close(t.closeReceived) })
+	return t.closeSent.CompareAndSwap(false, true)
+}
@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestGracefulClose_Handshake(t *testing.T) {
+	client, server := newTransportPair(t, DefaultOptions, ws.Handshake{})
+
+	readErr := func(tp *websocketTransport) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.ReadAll(readerFunc(tp.Read))
+			done <- err
+		}()
+		return done
+	}
+
+	serverErr := readErr(server)
+	clientErr := readErr(client)
+
+	start := time.Now()
+	if err := client.GracefulClose(int(ws.StatusPolicyViolation), "bye"); err != nil {
+		t.Fatalf("graceful close error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= DefaultOptions.CloseTimeout {
+		t.Fatalf("graceful close waited for the timeout: %v", elapsed)
+	}
+
+	var ce CloseError
+	if err := <-serverErr; !errors.As(err, &ce) {
+		t.Fatalf("expected CloseError on server, got: %v", err)
+	}
+	if ce.Code != ws.StatusPolicyViolation || ce.Reason != "bye" {
+		t.Fatalf("unexpected close error: %+v", ce)
+	}
+
+	if err := <-clientErr; !IsCloseError(err, ws.StatusPolicyViolation) {
+		t.Fatalf("expected echoed CloseError on client, got: %v", err)
+	}
+}
+
+func TestGracefulClose_FromReadLoop(t *testing.T) {
+	client, server := newTransportPair(t, DefaultOptions, ws.Handshake{})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(readerFunc(server.Read))
+		serverErr <- err
+	}()
+
+	// a handler closes the connection on the goroutine reading it
+	clientErr := make(chan error, 1)
+	go func() {
+		if _, err := client.Read(make([]byte, 16)); err != io.EOF {
+			clientErr <- err
+			return
+		}
+		if err := client.GracefulClose(int(ws.StatusNormalClosure), "done"); err != nil {
+			clientErr <- err
+			return
+		}
+		_, err := io.ReadAll(readerFunc(client.Read))
+		clientErr <- err
+	}()
+
+	start := time.Now()
+	if _, err := server.Write([]byte("bye")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if err := <-clientErr; !IsCloseError(err, ws.StatusNormalClosure) {
+		t.Fatalf("expected the echoed close frame, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= DefaultOptions.CloseTimeout {
+		t.Fatalf("graceful close waited for the timeout: %v", elapsed)
+	}
+	if err := <-serverErr; !IsCloseError(err, ws.StatusNormalClosure) {
+		t.Fatalf("expected the close frame on server, got %v", err)
+	}
+
+	// the close handshake closed the transport
+	if _, err := client.Write([]byte("late")); err == nil {
+		t.Fatalf("expected write on a closed transport to fail")
+	}
+}
+
+func TestGracefulClose_Timeout(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CloseTimeout = 50 * time.Millisecond
+	client, server := newTransportPair(t, &opts, ws.Handshake{})
+
+	// the peer reads the close frame but never answers
+	go func() { _, _ = ws.ReadFrame(server.Transport) }()
+
+	if err := client.GracefulClose(int(ws.StatusNormalClosure), "bye"); err != nil {
+		t.Fatalf("graceful close error: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the timer to close the transport")
+	}
+}
+
+func TestIsCloseError(t *testing.T) {
+	err := wrapCloseError(errors.New("other"))
+	if IsCloseError(err) {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	err = CloseError{Code: 4001, Reason: "custom"}
+	if !IsCloseError(err) || !IsCloseError(err, ws.StatusNormalClosure, 4001) {
+		t.Fatalf("expected close error 4001: %v", err)
+	}
+	if IsCloseError(err, ws.StatusGoingAway) {
+		t.Fatalf("unexpected close error code match: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws/wsflate"
+)
+
+// CompressFilter reports whether permessage-deflate may be negotiated for the
+// upgrade request, returning false declines compression for the connection.
+type CompressFilter func(request *http.Request) bool
+
+// deflateParameters returns the permessage-deflate parameters (RFC 7692) of the options,
+// context takeover is opt-in as it keeps a compression window per connection.
+func (o *Options) deflateParameters() wsflate.Parameters {
+	for _, bits := range []int{o.ServerMaxWindowBits, o.ClientMaxWindowBits} {
+		if 0 != bits && (bits < 8 || bits > 15) {
+			panic(fmt.Errorf("websocket: invalid max window bits: %d", bits))
+		}
+	}
+
+	return wsflate.Parameters{
+		ServerNoContextTakeover: !o.ServerContextTakeover,
+		ClientNoContextTakeover: !o.ClientContextTakeover,
+		ServerMaxWindowBits:     wsflate.WindowBits(o.ServerMaxWindowBits),
+		ClientMaxWindowBits:     wsflate.WindowBits(o.ClientMaxWindowBits),
+	}
+}
+
+// deflateOffer returns the permessage-deflate offer of a client, it always
+// announces client_max_window_bits so the server may limit our window.
+func (o *Options) deflateOffer() httphead.Option {
+	params := o.deflateParameters()
+	if !params.ClientMaxWindowBits.Defined() {
+		// without value
+		params.ClientMaxWindowBits = 1
+	}
+	return params.Option()
+}
+
+// deflateNegotiator accepts the first acceptable permessage-deflate offer of an
+// upgrade request, the response combines the offer with the server parameters.
+type deflateNegotiator struct {
+	params   wsflate.Parameters
+	accepted bool
+}
+
+func (n *deflateNegotiator) Negotiate(option httphead.Option) (accept httphead.Option, err error) {
+
+	if n.accepted || !bytes.Equal(option.Name, wsflate.ExtensionNameBytes) {
+		return accept, nil
+	}
+
+	var offer wsflate.Parameters
+	if err = offer.Parse(option); nil != err {
+		// decline the offer, the client may have sent another one
+		return accept, nil
+	}
+
+	params := wsflate.Parameters{
+		ServerNoContextTakeover: n.params.ServerNoContextTakeover || offer.ServerNoContextTakeover,
+		ClientNoContextTakeover: n.params.ClientNoContextTakeover || offer.ClientNoContextTakeover,
+		ServerMaxWindowBits:     minWindowBits(n.params.ServerMaxWindowBits, offer.ServerMaxWindowBits),
+	}
+
+	switch {
+	case 1 == offer.ClientMaxWindowBits:
+		// supported by the client without a limit of its own
+		params.ClientMaxWindowBits = n.params.ClientMaxWindowBits
+	case offer.ClientMaxWindowBits.Defined():
+		params.ClientMaxWindowBits = minWindowBits(n.params.ClientMaxWindowBits, offer.ClientMaxWindowBits)
+	case n.params.ClientMaxWindowBits.Defined():
+		// the client can't limit its window
+		return accept, nil
+	}
+
+	n.accepted = true
+	return params.Option(), nil
+}
+
+func minWindowBits(a, b wsflate.WindowBits) wsflate.WindowBits {
+	if !a.Defined() || (b.Defined() && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,252 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+func negotiateDeflate(t *testing.T, server wsflate.Parameters, offers ...wsflate.Parameters) (wsflate.Parameters, bool) {
+	n := &deflateNegotiator{params: server}
+	for _, offer := range offers {
+		accept, err := n.Negotiate(offer.Option())
+		if err != nil {
+			t.Fatalf("negotiate error: %v", err)
+		}
+		if len(accept.Name) > 0 {
+			var params wsflate.Parameters
+			if err = params.Parse(accept); err != nil {
+				t.Fatalf("parse response error: %v", err)
+			}
+			return params, true
+		}
+	}
+	return wsflate.Parameters{}, false
+}
+
+func TestDeflateNegotiator(t *testing.T) {
+	cases := []struct {
+		name   string
+		server wsflate.Parameters
+		offers []wsflate.Parameters
+		want   wsflate.Parameters
+		ok     bool
+	}{
+		{
+			name:   "require server no context takeover",
+			server: wsflate.Parameters{ServerNoContextTakeover: true},
+			offers: []wsflate.Parameters{{}},
+			want:   wsflate.Parameters{ServerNoContextTakeover: true},
+			ok:     true,
+		},
+		{
+			name:   "honor client requests",
+			server: wsflate.Parameters{},
+			offers: []wsflate.Parameters{{ServerNoContextTakeover: true, ServerMaxWindowBits: 10}},
+			want:   wsflate.Parameters{ServerNoContextTakeover: true, ServerMaxWindowBits: 10},
+			ok:     true,
+		},
+		{
+			name:   "limit client window",
+			server: wsflate.Parameters{ClientMaxWindowBits: 10},
+			offers: []wsflate.Parameters{{ClientMaxWindowBits: 1}},
+			want:   wsflate.Parameters{ClientMaxWindowBits: 10},
+			ok:     true,
+		},
+		{
+			name:   "smallest window wins",
+			server: wsflate.Parameters{ServerMaxWindowBits: 12, ClientMaxWindowBits: 12},
+			offers: []wsflate.Parameters{{ServerMaxWindowBits: 9, ClientMaxWindowBits: 14}},
+			want:   wsflate.Parameters{ServerMaxWindowBits: 9, ClientMaxWindowBits: 12},
+			ok:     true,
+		},
+		{
+			name:   "client can't limit its window",
+			server: wsflate.Parameters{ClientMaxWindowBits: 10},
+			offers: []wsflate.Parameters{{}},
+			ok:     false,
+		},
+		{
+			name:   "fall back to second offer",
+			server: wsflate.Parameters{ClientMaxWindowBits: 10},
+			offers: []wsflate.Parameters{{}, {ClientMaxWindowBits: 1, ClientNoContextTakeover: true}},
+			want:   wsflate.Parameters{ClientMaxWindowBits: 10, ClientNoContextTakeover: true},
+			ok:     true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := negotiateDeflate(t, c.server, c.offers...)
+			if ok != c.ok || got != c.want {
+				t.Fatalf("unexpected negotiation: got %+v (%v), want %+v (%v)", got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+func TestDeflateParameters_ContextTakeoverOptIn(t *testing.T) {
+	params := (&Options{CompressEnabled: true}).deflateParameters()
+	if !params.ServerNoContextTakeover || !params.ClientNoContextTakeover {
+		t.Fatalf("expected no context takeover by default: %+v", params)
+	}
+
+	params = (&Options{CompressEnabled: true, ServerContextTakeover: true, ClientContextTakeover: true}).deflateParameters()
+	if params.ServerNoContextTakeover || params.ClientNoContextTakeover {
+		t.Fatalf("expected context takeover when allowed: %+v", params)
+	}
+}
+
+func TestDeflateNegotiator_FirstOfferOnly(t *testing.T) {
+	n := &deflateNegotiator{}
+	for i := 0; i < 2; i++ {
+		accept, _ := n.Negotiate((wsflate.Parameters{}).Option())
+		if accepted := len(accept.Name) > 0; accepted != (0 == i) {
+			t.Fatalf("offer %d: unexpected accepted: %v", i, accepted)
+		}
+	}
+}
+
+func TestContextTakeover_RoundTrip(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	opts.CompressThreshold = 1
+	opts.FragmentSize = 64
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+	client, server := newTransportPair(t, opts.Apply(), hs)
+
+	if client.persistentFlateWriter == nil || server.persistentFlateReader == nil {
+		t.Fatalf("expected persistent flate instances with context takeover")
+	}
+
+	for i := 0; i < 8; i++ {
+		// repeated content is compressed as references to the previous messages
+		payload := []byte(fmt.Sprintf("context-takeover-message;context-takeover-message;%d", i))
+		go func() {
+			if i%2 == 0 {
+				_, _ = client.Write(append([]byte(nil), payload...))
+				return
+			}
+			w, _ := client.NextWriter(ws.OpText)
+			_, _ = w.Write(payload[:10])
+			_, _ = w.Write(payload[10:])
+			_ = w.Close()
+		}()
+
+		got, err := io.ReadAll(readerFunc(server.Read))
+		if err != nil {
+			t.Fatalf("message %d: read error: %v", i, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("message %d: unexpected payload: %q", i, got)
+		}
+	}
+}
+
+func TestCompress_NegotiatedParameters(t *testing.T) {
+	serverOpts := *DefaultOptions
+	serverOpts.CompressEnabled = true
+	serverOpts.CompressThreshold = 1
+	serverOpts.ServerContextTakeover = true
+	serverOpts.ClientContextTakeover = true
+	serverOpts.ClientMaxWindowBits = 10
+	acceptor := listenWebsocket(t, serverOpts.Apply())
+
+	clientOpts := *DefaultOptions
+	clientOpts.CompressEnabled = true
+	clientOpts.CompressThreshold = 1
+	clientOpts.ServerContextTakeover = true
+	clientOpts.ClientContextTakeover = true
+	clientOpts.ServerMaxWindowBits = 11
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", clientOpts.Apply())
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+
+	accepted, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	server := accepted.(*websocketTransport)
+	defer server.Close()
+
+	for _, tp := range []*websocketTransport{client, server} {
+		n := tp.negotiated
+		if !n.enabled || n.serverNoContextTake || n.clientNoContextTake || n.serverMaxWindowBits != 11 || n.clientMaxWindowBits != 10 {
+			t.Fatalf("unexpected negotiated parameters: %+v", n)
+		}
+	}
+
+	payload := bytes.Repeat([]byte("negotiated;"), 64)
+	for i := 0; i < 3; i++ {
+		go func() { _, _ = server.Write(payload) }()
+		got, err := io.ReadAll(readerFunc(client.Read))
+		if err != nil {
+			t.Fatalf("client read error: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("unexpected payload: got %d bytes", len(got))
+		}
+	}
+}
+
+func TestCompress_FilterDeclines(t *testing.T) {
+	serverOpts := *DefaultOptions
+	serverOpts.CompressEnabled = true
+	serverOpts.CompressFilter = func(request *http.Request) bool {
+		return request.URL.Query().Get("compress") != "off"
+	}
+	acceptor := listenWebsocket(t, serverOpts.Apply())
+
+	clientOpts := *DefaultOptions
+	clientOpts.CompressEnabled = true
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws?compress=off", clientOpts.Apply())
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+
+	accepted, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer accepted.Close()
+
+	if client.negotiated.enabled || accepted.(*websocketTransport).negotiated.enabled {
+		t.Fatalf("expected compression to be declined")
+	}
+}
+
+func TestContextTakeover_CloseWhileReading(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	opts.CompressThreshold = 1
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+	client, server := newTransportPair(t, opts.Apply(), hs)
+	defer client.Close()
+
+	go func() {
+		payload := bytes.Repeat([]byte("close-while-reading;"), 256)
+		for {
+			if _, err := client.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := drain(server)
+	time.Sleep(20 * time.Millisecond)
+	// closed from another goroutine, as the keepalive does for a dead peer
+	_ = server.Close()
+	<-done
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+type headerContextKey struct{}
+
+// WithHeader adds headers to the handshake request of a client connection.
+func WithHeader(header http.Header) transport.Option {
+	return func(options *transport.Options) error {
+		h := headerFromContext(options.Context).Clone()
+		if nil == h {
+			h = make(http.Header, len(header))
+		}
+		for key, values := range header {
+			for _, value := range values {
+				h.Add(key, value)
+			}
+		}
+		options.Context = context.WithValue(options.Context, headerContextKey{}, h)
+		return nil
+	}
+}
+
+// WithCookies adds cookies to the handshake request of a client connection.
+func WithCookies(cookies ...*http.Cookie) transport.Option {
+	request := &http.Request{Header: make(http.Header)}
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	return WithHeader(request.Header)
+}
+
+func headerFromContext(ctx context.Context) http.Header {
+	if h, ok := ctx.Value(headerContextKey{}).(http.Header); ok {
+		return h
+	}
+	return nil
+}
+
+// Response returns the handshake response of a client connection, nil on the server side.
+func (t *websocketTransport) Response() *http.Response {
+	return t.response
+}
+
+// handshakeHeaders writes the configured dialer header followed by the per-dial headers.
+type handshakeHeaders []ws.HandshakeHeader
+
+func (hs handshakeHeaders) WriteTo(w io.Writer) (n int64, err error) {
+	for _, h := range hs {
+		if nil == h {
+			continue
+		}
+		var m int64
+		m, err = h.WriteTo(w)
+		if n += m; nil != err {
+			break
+		}
+	}
+	return n, err
+}
+
+// bufferedConn reads the frames the peer sent along with the handshake response
+// before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if nil != c.reader {
+		if c.reader.Buffered() > 0 {
+			return c.reader.Read(p)
+		}
+		ws.PutReader(c.reader)
+		c.reader = nil
+	}
+	return c.Conn.Read(p)
+}
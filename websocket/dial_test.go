@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/go-netty/go-netty/transport"
+)
+
+func TestConnect_QueryHeadersAndCookies(t *testing.T) {
+	serverOpts := *DefaultOptions
+	serverOpts.CheckUpgrade = func(request *http.Request) (UpgradeAccept, error) {
+		return UpgradeAccept{Header: http.Header{"Set-Cookie": {"session=s1; Path=/"}}}, nil
+	}
+	acceptor := listenWebsocket(t, &serverOpts)
+
+	options, err := transport.ParseOptions(context.Background(), "ws://"+acceptor.httpServer.Addr+"/ws?token=abc",
+		WithOptions(DefaultOptions),
+		WithHeader(http.Header{"X-Client": {"dashboard"}}),
+		WithCookies(&http.Cookie{Name: "auth", Value: "c1"}),
+	)
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	tt, err := New().Connect(options)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	defer tt.Close()
+
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	request := server.(Transport).Request()
+	if got := request.URL.Query().Get("token"); got != "abc" {
+		t.Fatalf("query lost: %q", request.URL.RawQuery)
+	}
+	if got := request.Header.Get("X-Client"); got != "dashboard" {
+		t.Fatalf("header lost: %v", request.Header)
+	}
+	if cookie, err := request.Cookie("auth"); err != nil || cookie.Value != "c1" {
+		t.Fatalf("cookie lost: %v", request.Header)
+	}
+	if got := server.(Transport).Header().Get("X-Client"); got != "dashboard" {
+		t.Fatalf("unexpected server header: %v", server.(Transport).Header())
+	}
+
+	client := tt.(Transport)
+	if got := client.Request().URL.RawQuery; got != "token=abc" {
+		t.Fatalf("unexpected client request query: %q", got)
+	}
+	response := client.Response()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected response status: %d", response.StatusCode)
+	}
+	if got := client.Header().Get("Set-Cookie"); got != "session=s1; Path=/" {
+		t.Fatalf("unexpected client header: %v", client.Header())
+	}
+	cookies := response.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "s1" {
+		t.Fatalf("unexpected response cookies: %v", cookies)
+	}
+}
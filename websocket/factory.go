@@ -17,14 +17,20 @@
 package websocket
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-netty/go-netty/transport"
 	"github.com/gobwas/ws"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // New websocket transport factory
@@ -35,157 +41,568 @@ func New() transport.Factory {
 type websocketFactory struct{}
 
 func (*websocketFactory) Schemes() transport.Schemes {
-	return transport.Schemes{"ws", "wss"}
+	return transport.Schemes{"ws", "wss", "ws+unix", "wss+unix"}
 }
 
+// Connect dials a websocket, with Options.Reconnect the returned transport dials
+// again whenever its connection is lost.
 func (w *websocketFactory) Connect(options *transport.Options) (transport.Transport, error) {
 
 	if err := w.Schemes().FixScheme(options.Address); nil != err {
 		return nil, err
 	}
 
+	if reconnect := FromContext(options.Context, DefaultOptions).Reconnect; nil != reconnect {
+		return dialReconnecting(w, options, reconnect)
+	}
+
+	tt, err := w.connect(options)
+	if nil != err {
+		return nil, err
+	}
+	return tt, nil
+}
+
+func (w *websocketFactory) connect(options *transport.Options) (Transport, error) {
+
 	wsOptions := FromContext(options.Context, DefaultOptions)
 
 	wsDialer := wsOptions.Dialer // copy dialer
 
-	headers := make(http.Header)
+	// trusted roots, client certificates and server name of wss
+	if nil == wsDialer.TLSConfig {
+		wsDialer.TLSConfig = wsOptions.TLS
+	}
+
+	if 0 == wsDialer.Timeout {
+		wsDialer.Timeout = wsOptions.HandshakeTimeout
+	}
+
+	// per-dial request headers
+	requestHeader := headerFromContext(options.Context)
+
+	u := &url.URL{Scheme: options.Address.Scheme, Host: options.Address.Host, Path: options.Address.Path, RawPath: options.Address.RawPath, RawQuery: options.Address.RawQuery}
+
+	if scheme, unix := splitUnixScheme(u.Scheme); unix {
+		if wsOptions.HTTP2 || wsOptions.HTTP3 {
+			return nil, errUnixStream
+		}
+		socket, route := unixAddress(options.Address)
+		u.Scheme, u.Host, u.Path, u.RawPath = scheme, unixHost, route, ""
+		if nil == wsDialer.NetDial {
+			wsDialer.NetDial = unixDial(socket)
+		}
+	}
+
+	if wsOptions.HTTP3 && "wss" != u.Scheme {
+		return nil, errHTTP3Scheme
+	}
+
+	if wsOptions.HTTP2 || wsOptions.HTTP3 {
+		// the streams share the connections of the stream client
+		if nil != wsOptions.Proxy || nil != wsDialer.NetDial {
+			return nil, errStreamDial
+		}
+		tt, err := connectStream(options.Context, wsOptions, wsDialer, u, requestHeader)
+		if nil != err {
+			return nil, err
+		}
+		return tt, nil
+	}
+
+	if len(requestHeader) > 0 {
+		wsDialer.Header = handshakeHeaders{wsDialer.Header, ws.HandshakeHeaderHTTP(requestHeader)}
+	}
+
+	responseHeader := make(http.Header)
 	wsDialer.OnHeader = func(key, value []byte) (err error) {
-		headers.Add(string(key), string(value))
+		responseHeader.Add(string(key), string(value))
 		return nil
 	}
 
-	u := &url.URL{Scheme: options.Address.Scheme, Host: options.Address.Host, Path: options.Address.Path}
-	conn, _, hs, err := wsDialer.Dial(options.Context, u.String())
+	// tunnel through the proxy before the TLS and websocket handshakes
+	if nil != wsOptions.Proxy && nil == wsDialer.NetDial {
+		netDial, err := proxyDialer(wsOptions.Proxy, u)
+		if nil != err {
+			return nil, err
+		}
+		wsDialer.NetDial = netDial
+	}
+
+	conn, br, hs, err := wsDialer.Dial(options.Context, u.String())
 	if nil != err {
+		// the upgrade may have been stripped by a proxy on the way
+		if wsOptions.LongPolling && nil == options.Context.Err() {
+			if tt, perr := connectPolling(options.Context, wsOptions, wsDialer, u, requestHeader); nil == perr {
+				return tt, nil
+			}
+		}
 		return nil, err
 	}
 
+	if nil != br {
+		// frames sent along with the handshake response
+		conn = &bufferedConn{Conn: conn, reader: br}
+	}
+
+	if nil == requestHeader {
+		requestHeader = make(http.Header)
+	}
+
 	request := &http.Request{
 		Method:     http.MethodGet,
 		URL:        u,
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     headers,
+		Header:     requestHeader,
 		Body:       http.NoBody,
 		Host:       u.Host,
 		RemoteAddr: conn.RemoteAddr().String(),
 		RequestURI: u.RequestURI(),
 	}
 
+	response := &http.Response{
+		Status:     "101 Switching Protocols",
+		StatusCode: http.StatusSwitchingProtocols,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     responseHeader,
+		Body:       http.NoBody,
+		Request:    request,
+	}
+
 	tt, err := newWebsocketTransport(conn, wsOptions, true, request, hs)
 	if nil != err {
 		_ = conn.Close()
 		return nil, err
 	}
+	tt.response = response
 	return tt, nil
 }
 
+// Listen serves the websocket routes on a ServeMux of its own, unless
+// Options.ServeMux is set to share one. The routes of a shared ServeMux are
+// unregistered when the acceptor is closed, so the path may be listened again.
 func (w *websocketFactory) Listen(options *transport.Options) (transport.Acceptor, error) {
 
 	if err := w.Schemes().FixScheme(options.Address); nil != err {
 		return nil, err
 	}
 
-	listen, err := net.Listen("tcp", options.AddressWithoutHost())
+	scheme, unix := splitUnixScheme(options.Address.Scheme)
+	route := options.Address.Path
+
+	var listen net.Listener
+	var err error
+	if unix {
+		var socket string
+		socket, route = unixAddress(options.Address)
+		listen, err = net.Listen("unix", socket)
+	} else {
+		listen, err = net.Listen("tcp", options.AddressWithoutHost())
+	}
 	if nil != err {
 		return nil, err
 	}
 
 	wsOptions := FromContext(options.Context, DefaultOptions)
+
+	if "wss" == scheme && !hasCertificate(wsOptions.TLS) {
+		_ = listen.Close()
+		return nil, errors.New("wss listener requires a certificate in Options.TLS")
+	}
+
 	// websocket acceptor backlog size
 	backlog := wsOptions.Backlog
 	if backlog < 64 {
 		backlog = 64
 	}
 
+	// a mux of our own, unless Options.ServeMux opts in to share one
+	mux := wsOptions.ServeMux
+	if nil == mux {
+		mux = http.NewServeMux()
+	}
+
+	httpServer, err := newHTTPServer(listen.Addr().String(), mux, wsOptions, "wss" == scheme)
+	if nil != err {
+		_ = listen.Close()
+		return nil, err
+	}
+
 	wa := &wsAcceptor{
 		wsOptions:    wsOptions,
 		incoming:     make(chan acceptEvent, backlog),
-		httpServer:   &http.Server{Addr: listen.Addr().String(), Handler: wsOptions.ServeMux, TLSConfig: wsOptions.TLS},
+		httpServer:   httpServer,
 		closedSignal: make(chan struct{}),
+		serveDone:    make(chan struct{}),
+		transports:   make(map[liveTransport]struct{}),
+		sessions:     make(map[string]*pollingTransport),
+	}
+
+	// wss over HTTP/3 on the UDP port of the same number
+	if wsOptions.HTTP3 {
+		if "wss" != options.Address.Scheme {
+			_ = listen.Close()
+			return nil, errHTTP3Scheme
+		}
+		if wa.http3Server, wa.packetConn, err = listenHTTP3(listen.Addr(), mux, wsOptions); nil != err {
+			_ = listen.Close()
+			return nil, err
+		}
 	}
 
-	var routers = []string{options.Address.Path}
+	var routers = []string{route}
 	if len(wa.wsOptions.Routers) > 0 {
 		routers = wa.wsOptions.Routers
 	}
 
 	for _, router := range routers {
-		wa.wsOptions.ServeMux.HandleFunc(router, wa.upgradeHTTP)
+		if nil == wsOptions.ServeMux {
+			mux.HandleFunc(router, wa.upgradeHTTP)
+		} else if err = wa.handleShared(mux, router); nil != err {
+			wa.unhandleShared()
+			_ = wa.closeHTTP3()
+			_ = listen.Close()
+			return nil, err
+		}
 	}
 
-	errorChan := make(chan error, 1)
-
+	// the socket is bound, later server errors are returned by Accept
 	go func() {
-		switch options.Address.Scheme {
+		var err error
+		switch scheme {
 		case "ws":
-			errorChan <- wa.httpServer.Serve(listen)
+			err = wa.httpServer.Serve(listen)
 		case "wss":
-			errorChan <- wa.httpServer.ServeTLS(listen, "", "")
+			err = wa.httpServer.ServeTLS(listen, "", "")
+		}
+
+		if http.ErrServerClosed == err {
+			err = errAcceptorClosed
 		}
+		wa.serveErr = err
+		close(wa.serveDone)
 	}()
 
-	select {
-	case err = <-errorChan:
-		return nil, err
-	case <-time.After(time.Second):
-		// temporary plan
-		// waiting for server initialization
-		return wa, nil
+	if nil != wa.http3Server {
+		// stopped along with the HTTP server
+		go func() { _ = wa.http3Server.Serve(wa.packetConn) }()
+	}
+
+	return wa, nil
+}
+
+func newHTTPServer(addr string, handler http.Handler, options *Options, secure bool) (*http.Server, error) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         options.TLS,
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		IdleTimeout:       options.HTTPIdleTimeout,
+		MaxHeaderBytes:    options.MaxHeaderBytes,
+	}
+
+	// the request is the first half of the handshake
+	if 0 == server.ReadHeaderTimeout {
+		server.ReadHeaderTimeout = options.HandshakeTimeout
+	}
+
+	if options.HTTP2 {
+		if err := configureHTTP2(server, secure); nil != err {
+			return nil, err
+		}
 	}
+	return server, nil
+}
+
+func hasCertificate(config *tls.Config) bool {
+	return nil != config && (len(config.Certificates) > 0 || nil != config.GetCertificate || nil != config.GetConfigForClient)
 }
 
 type acceptEvent struct {
-	conn    net.Conn
-	request *http.Request
-	hs      ws.Handshake
+	conn       net.Conn          // holds a connection slot until closed
+	session    *pollingTransport // or the long-polling session
+	request    *http.Request
+	hs         ws.Handshake
+	attachment interface{}
+}
+
+var errAcceptorClosed = errors.New("ws acceptor closed")
+
+// GracefulAcceptor is implemented by the acceptor returned from Listen.
+type GracefulAcceptor interface {
+	transport.Acceptor
+
+	// Shutdown stops accepting upgrades and closes the live connections with
+	// 1001 Going Away, waiting for them until the context is done.
+	Shutdown(ctx context.Context) error
 }
 
+var _ GracefulAcceptor = (*wsAcceptor)(nil)
+
 type wsAcceptor struct {
 	httpServer   *http.Server
 	incoming     chan acceptEvent
 	closedSignal chan struct{}
 	wsOptions    *Options
+	serveDone    chan struct{}
+	serveErr     error
+	// live transports, drained by Shutdown
+	locker     sync.Mutex
+	transports map[liveTransport]struct{}
+	// long-polling sessions by id, see Options.LongPolling
+	sessions map[string]*pollingTransport
+	// routes served on a shared ServeMux
+	sharedRoutes []sharedRoute
+	// connections being upgraded, queued or live
+	connections atomic.Int64
+	// wss over HTTP/3, nil unless Options.HTTP3
+	http3Server *http3.Server
+	packetConn  net.PacketConn
 }
 
 func (w *wsAcceptor) upgradeHTTP(writer http.ResponseWriter, request *http.Request) {
 
-	conn, _, hs, err := w.wsOptions.Upgrader.Upgrade(request, writer)
+	polling := w.wsOptions.LongPolling && isPolling(request)
+	if id := request.URL.Query().Get(pollingSessionID); polling && "" != id {
+		w.servePolling(writer, request, id)
+		return
+	}
+
+	if !w.acquire() {
+		rejectUpgrade(writer, &RejectError{
+			Status: http.StatusServiceUnavailable,
+			Header: http.Header{"Retry-After": {retryAfter(w.wsOptions.RetryAfter)}},
+		})
+		return
+	}
+
+	posted := false
+	defer func() {
+		if !posted {
+			w.release()
+		}
+	}()
+
+	resolveRemoteAddr(request, w.wsOptions.trustedProxies)
+
+	upgrader, attachment, err := prepareUpgrade(w.wsOptions.Upgrader, w.wsOptions, writer, request)
 	if nil != err {
+		return
+	}
+
+	if polling {
+		if http.MethodPost != request.Method {
+			http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		session, err := w.openPolling(upgrader, writer, request, attachment)
+		if nil != err {
+			return
+		}
+		posted = w.post(acceptEvent{session: session, request: request, attachment: attachment})
+		return
+	}
+
+	var conn net.Conn
+	var hs ws.Handshake
+	if isExtendedConnect(request) {
+		var stream *streamConn
+		if stream, hs, err = upgradeStream(upgrader, writer, request); nil != err {
+			return
+		}
+		// the stream ends when the handler returns
+		defer stream.wait(request.Context())
+		conn = stream
+	} else if conn, _, hs, err = upgrader.Upgrade(request, writer); nil != err {
 		if nil != conn {
 			_ = conn.Close()
 		}
 		return
 	}
 
+	posted = w.post(acceptEvent{conn: conn, request: request, hs: hs, attachment: attachment})
+}
+
+// post queues the upgraded connection for Accept, it is closed instead if the
+// acceptor is closed.
+func (w *wsAcceptor) post(ev acceptEvent) bool {
+	select {
+	case <-w.closedSignal:
+		ev.close()
+		return false
+	case w.incoming <- ev:
+	}
+
 	select {
 	case <-w.closedSignal:
-		_ = conn.Close()
+		// posted while closing, nobody may accept it
+		w.drain()
+	default:
+	}
+	return true
+}
+
+func (ev acceptEvent) close() {
+	if nil != ev.session {
+		_ = ev.session.Close()
 		return
-	case w.incoming <- acceptEvent{conn: conn, request: request, hs: hs}:
-		// post to acceptor
 	}
+	_ = ev.conn.Close()
 }
 
 func (w *wsAcceptor) Accept() (transport.Transport, error) {
+
+	// closing wins over the queued connections
+	select {
+	case <-w.closedSignal:
+		w.drain()
+		return nil, errAcceptorClosed
+	default:
+	}
+
 	select {
 	case ev := <-w.incoming:
+		if nil != ev.session {
+			w.track(ev.session)
+			return ev.session, nil
+		}
 		tt, err := newWebsocketTransport(ev.conn, w.wsOptions, false, ev.request, ev.hs)
 		if nil != err {
 			_ = ev.conn.Close()
+			w.release()
 			return nil, err
 		}
+		tt.attachment = ev.attachment
+		w.track(tt)
 		return tt, nil
+	case <-w.serveDone:
+		w.drain()
+		return nil, w.serveErr
 	case <-w.closedSignal:
-		// close all incoming connections
-		for {
-			select {
-			case ev := <-w.incoming:
-				_ = ev.conn.Close()
-			default:
-				return nil, errors.New("ws acceptor closed")
+		w.drain()
+		return nil, errAcceptorClosed
+	}
+}
+
+// drain closes all incoming connections.
+func (w *wsAcceptor) drain() {
+	for {
+		select {
+		case ev := <-w.incoming:
+			ev.close()
+			w.release()
+		default:
+			return
+		}
+	}
+}
+
+// acquire takes a connection slot, it fails when Options.MaxConnections
+// connections are being upgraded or live already.
+func (w *wsAcceptor) acquire() bool {
+	if n := w.connections.Add(1); w.wsOptions.MaxConnections > 0 && n > int64(w.wsOptions.MaxConnections) {
+		w.connections.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release gives back a connection slot.
+func (w *wsAcceptor) release() {
+	w.connections.Add(-1)
+}
+
+// retryAfter returns the Retry-After seconds of a rejected upgrade.
+func retryAfter(d time.Duration) string {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// track holds the connection slot and registers the transport until it is closed.
+func (w *wsAcceptor) track(t liveTransport) {
+	t.onRelease(w.release)
+
+	w.locker.Lock()
+	w.transports[t] = struct{}{}
+	w.locker.Unlock()
+
+	t.onRelease(func() {
+		w.locker.Lock()
+		delete(w.transports, t)
+		w.locker.Unlock()
+	})
+
+	if nil != w.wsOptions.Registry {
+		w.wsOptions.Registry.add(t)
+	}
+}
+
+// Shutdown gracefully shuts down the acceptor: it stops accepting upgrades, sends
+// 1001 Going Away to the live connections and waits until they are closed or
+// the context is done, then the remaining connections are closed.
+func (w *wsAcceptor) Shutdown(ctx context.Context) error {
+
+	select {
+	case <-w.closedSignal:
+	default:
+		close(w.closedSignal)
+	}
+	w.drain()
+	w.unhandleShared()
+
+	w.locker.Lock()
+	live := make([]liveTransport, 0, len(w.transports))
+	for t := range w.transports {
+		live = append(live, t)
+	}
+	w.locker.Unlock()
+
+	for _, t := range live {
+		go func(t liveTransport) {
+			_ = t.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+			_ = t.WriteClose(int(ws.StatusGoingAway), "server shutdown")
+		}(t)
+	}
+
+	// waits for the HTTP/2 and HTTP/3 streams, they end with their transports
+	err := w.httpServer.Shutdown(ctx)
+	if herr := w.shutdownHTTP3(ctx); nil == err {
+		err = herr
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		w.locker.Lock()
+		remaining := len(w.transports)
+		w.locker.Unlock()
+
+		if 0 == remaining {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			w.locker.Lock()
+			live = live[:0]
+			for t := range w.transports {
+				live = append(live, t)
+			}
+			w.locker.Unlock()
+
+			for _, t := range live {
+				_ = t.Close()
 			}
+			return ctx.Err()
+		case <-ticker.C:
 		}
 	}
 }
@@ -197,6 +614,9 @@ func (w *wsAcceptor) Close() error {
 		return nil
 	default:
 		close(w.closedSignal)
+		w.drain()
+		w.unhandleShared()
+		_ = w.closeHTTP3()
 
 		if w.httpServer != nil {
 			return w.httpServer.Close()
@@ -0,0 +1,249 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+func TestListen_ReturnsWhenBound(t *testing.T) {
+	opts := *DefaultOptions
+
+	start := time.Now()
+	listenWebsocket(t, &opts)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("listen took too long: %v", elapsed)
+	}
+}
+
+func TestListen_WssWithoutCertificate(t *testing.T) {
+	opts := *DefaultOptions
+
+	options, err := transport.ParseOptions(context.Background(), "wss://127.0.0.1:0/ws", WithOptions(&opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	if _, err = New().Listen(options); err == nil {
+		t.Fatalf("expected wss listen without certificate to fail")
+	}
+}
+
+func TestAcceptor_AcceptAfterClose(t *testing.T) {
+	opts := *DefaultOptions
+	acceptor := listenWebsocket(t, &opts)
+
+	_ = acceptor.Close()
+	if _, err := acceptor.Accept(); err == nil {
+		t.Fatalf("expected accept on closed acceptor to fail")
+	}
+}
+
+func gracefulAcceptor(t *testing.T, acceptor transport.Acceptor) GracefulAcceptor {
+	graceful, ok := acceptor.(GracefulAcceptor)
+	if !ok {
+		t.Fatalf("acceptor %T can't shut down gracefully", acceptor)
+	}
+	return graceful
+}
+
+func TestAcceptor_ShutdownDrains(t *testing.T) {
+	opts := *DefaultOptions
+	acceptor := listenWebsocket(t, &opts)
+
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", DefaultOptions)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	// read loops, as run by the go-netty channels
+	clientErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(readerFunc(client.Read))
+		clientErr <- err
+	}()
+	go func() {
+		_, _ = io.ReadAll(readerFunc(server.Read))
+		_ = server.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := gracefulAcceptor(t, acceptor).Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+
+	if err := <-clientErr; !IsCloseError(err, ws.StatusGoingAway) {
+		t.Fatalf("expected going away close error, got: %v", err)
+	}
+
+	if _, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", DefaultOptions); err == nil {
+		t.Fatalf("expected connect after shutdown to fail")
+	}
+}
+
+func TestAcceptor_ShutdownTimeout(t *testing.T) {
+	opts := *DefaultOptions
+	acceptor := listenWebsocket(t, &opts)
+
+	if _, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", DefaultOptions); err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	if _, err := acceptor.Accept(); err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	// nobody reads, the connection never drains
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := gracefulAcceptor(t, acceptor).Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+
+	acceptor.locker.Lock()
+	defer acceptor.locker.Unlock()
+	if len(acceptor.transports) != 0 {
+		t.Fatalf("expected remaining transports to be closed")
+	}
+}
+
+func TestAcceptor_AcceptDrainsWhenClosed(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		c1, c2 := net.Pipe()
+		wa := &wsAcceptor{
+			incoming:     make(chan acceptEvent, 1),
+			closedSignal: make(chan struct{}),
+			serveDone:    make(chan struct{}),
+			serveErr:     errAcceptorClosed,
+		}
+		wa.incoming <- acceptEvent{conn: c1}
+		close(wa.closedSignal)
+		close(wa.serveDone)
+
+		if _, err := wa.Accept(); err == nil {
+			t.Fatalf("expected accept on closed acceptor to fail")
+		}
+		// the queued connection is closed, not leaked
+		if _, err := c2.Write([]byte{0}); err != io.ErrClosedPipe {
+			t.Fatalf("expected queued connection to be closed, got: %v", err)
+		}
+	}
+}
+
+func TestListen_OwnServeMuxPerListener(t *testing.T) {
+	// the same path on two listeners of the default options
+	for i := 0; i < 2; i++ {
+		acceptor := listenWebsocket(t, DefaultOptions)
+		if _, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", DefaultOptions); err != nil {
+			t.Fatalf("listener %d: connect error: %v", i, err)
+		}
+		if _, err := acceptor.Accept(); err != nil {
+			t.Fatalf("listener %d: accept error: %v", i, err)
+		}
+	}
+}
+
+func TestListen_SharedServeMux(t *testing.T) {
+	opts := *DefaultOptions
+	opts.ServeMux = http.NewServeMux()
+
+	first := listenWebsocket(t, &opts)
+
+	options, err := transport.ParseOptions(context.Background(), "ws://127.0.0.1:0/ws", WithOptions(&opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	if _, err = New().Listen(options); err == nil {
+		t.Fatalf("expected a served route not to be listened twice")
+	}
+
+	// the route is unregistered on close and may be listened again
+	_ = first.Close()
+	recorder := httptest.NewRecorder()
+	opts.ServeMux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected closed route to answer 404, got %d", recorder.Code)
+	}
+
+	second := listenWebsocket(t, &opts)
+	if _, err := connectWebsocket(t, "ws://"+second.httpServer.Addr+"/ws", DefaultOptions); err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	if _, err := second.Accept(); err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+}
+
+func TestListen_MaxConnections(t *testing.T) {
+	opts := *DefaultOptions
+	opts.MaxConnections = 1
+	opts.RetryAfter = 1500 * time.Millisecond
+	acceptor := listenWebsocket(t, &opts)
+	url := "ws://" + acceptor.httpServer.Addr + "/ws"
+
+	if _, err := connectWebsocket(t, url, DefaultOptions); err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	response := upgradeRequest(t, "http://"+acceptor.httpServer.Addr+"/ws", http.Header{})
+	if response.StatusCode != http.StatusServiceUnavailable || response.Header.Get("Retry-After") != "2" {
+		t.Fatalf("unexpected over-limit response: %d, Retry-After %q", response.StatusCode, response.Header.Get("Retry-After"))
+	}
+
+	// closing the live connection frees its slot
+	_ = server.Close()
+	if _, err := connectWebsocket(t, url, DefaultOptions); err != nil {
+		t.Fatalf("connect after close error: %v", err)
+	}
+}
+
+func TestListen_HandshakeTimeout(t *testing.T) {
+	opts := *DefaultOptions
+	opts.HandshakeTimeout = 50 * time.Millisecond
+	acceptor := listenWebsocket(t, &opts)
+
+	conn, err := net.Dial("tcp", acceptor.httpServer.Addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+
+	// a slow client never finishes its request headers
+	if _, err = conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\n")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.ReadAll(conn); err != nil {
+		t.Fatalf("expected the server to close the connection, got: %v", err)
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	opts := *DefaultOptions
+	opts.HandshakeTimeout = time.Second
+	opts.HTTPIdleTimeout = 2 * time.Second
+	opts.MaxHeaderBytes = 4096
+	server, _ := newHTTPServer("127.0.0.1:0", http.NewServeMux(), &opts, false)
+	if server.ReadHeaderTimeout != time.Second || server.IdleTimeout != 2*time.Second || server.MaxHeaderBytes != 4096 {
+		t.Fatalf("unexpected server settings: %v, %v, %d", server.ReadHeaderTimeout, server.IdleTimeout, server.MaxHeaderBytes)
+	}
+
+	opts.ReadHeaderTimeout = 3 * time.Second
+	if server, _ = newHTTPServer("127.0.0.1:0", http.NewServeMux(), &opts, false); server.ReadHeaderTimeout != 3*time.Second {
+		t.Fatalf("unexpected read header timeout: %v", server.ReadHeaderTimeout)
+	}
+}
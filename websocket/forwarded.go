@@ -0,0 +1,140 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses the CIDRs and the addresses of Options.TrustedProxies.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if nil != err {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(proxy)
+		if nil != err {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func trusted(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRemoteAddr sets the RemoteAddr of a request sent by a trusted proxy to
+// the client address it forwarded. The hops of Forwarded, X-Forwarded-For or
+// else X-Real-IP are walked from the nearest one, the first hop that is not a
+// trusted proxy is the client.
+func resolveRemoteAddr(request *http.Request, prefixes []netip.Prefix) {
+
+	if 0 == len(prefixes) {
+		return
+	}
+
+	peer, err := netip.ParseAddrPort(request.RemoteAddr)
+	if nil != err || !trusted(prefixes, peer.Addr()) {
+		return
+	}
+
+	hops := forwardedFor(request.Header.Values("Forwarded"))
+	if 0 == len(hops) {
+		hops = splitHops(request.Header.Values("X-Forwarded-For"))
+	}
+	if 0 == len(hops) {
+		hops = splitHops(request.Header.Values("X-Real-IP"))
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(hops[i])
+		if !ok {
+			// obfuscated or malformed, the chain ends here
+			break
+		}
+		if client = hop; !trusted(prefixes, hop.Addr()) {
+			break
+		}
+	}
+
+	request.RemoteAddr = client.String()
+}
+
+// forwardedFor returns the for= parameters of Forwarded headers (RFC 7239).
+func forwardedFor(values []string) (hops []string) {
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, hop, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold("for", key) {
+					hops = append(hops, strings.Trim(hop, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+func splitHops(values []string) (hops []string) {
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); "" != hop {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address with an optional port, port 0 if none.
+func parseHop(hop string) (netip.AddrPort, bool) {
+	if addrPort, err := netip.ParseAddrPort(hop); nil == err {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(hop, "[]")); nil == err {
+		return netip.AddrPortFrom(addr.Unmap(), 0), true
+	}
+	return netip.AddrPort{}, false
+}
+
+// RemoteAddr returns the client address, resolved from the forwarding headers
+// when the connection comes from one of Options.TrustedProxies.
+func (t *websocketTransport) RemoteAddr() net.Addr {
+	if nil != t.remoteAddr {
+		return t.remoteAddr
+	}
+	return t.Transport.RemoteAddr()
+}
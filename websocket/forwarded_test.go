@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-netty/go-netty/transport"
+)
+
+func TestResolveRemoteAddr(t *testing.T) {
+	prefixes, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"untrusted peer", "203.0.113.9:5000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.9:5000"},
+		{"no headers", "10.0.0.1:5000", nil, "10.0.0.1:5000"},
+		{"x-forwarded-for", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"198.51.100.1, 10.1.1.1"}}, "198.51.100.1:0"},
+		{"spoofed hop", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1", "10.1.1.1"}}, "198.51.100.1:0"},
+		{"all trusted", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"192.0.2.1, 10.1.1.1"}}, "192.0.2.1:0"},
+		{"forwarded", "10.0.0.1:5000", http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711", for=198.51.100.7;proto=https`}, "X-Forwarded-For": {"1.1.1.1"}}, "198.51.100.7:0"},
+		{"forwarded ipv6", "10.0.0.1:5000", http.Header{"Forwarded": {`for="[2001:db9::17]:4711";by=10.0.0.1`}}, "[2001:db9::17]:4711"},
+		{"obfuscated", "10.0.0.1:5000", http.Header{"Forwarded": {"for=_hidden, for=10.2.2.2"}}, "10.2.2.2:0"},
+		{"x-real-ip", "[::ffff:10.0.0.1]:5000", http.Header{"X-Real-Ip": {"198.51.100.3"}}, "198.51.100.3:0"},
+	} {
+		request := &http.Request{RemoteAddr: c.remote, Header: c.header}
+		if nil == request.Header {
+			request.Header = make(http.Header)
+		}
+		resolveRemoteAddr(request, prefixes)
+		if request.RemoteAddr != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, request.RemoteAddr, c.want)
+		}
+	}
+}
+
+func TestTrustedProxies_TransportRemoteAddr(t *testing.T) {
+	for _, c := range []struct {
+		proxies []string
+		want    string
+	}{
+		{[]string{"127.0.0.0/8"}, "198.51.100.1:0"},
+		{[]string{"10.0.0.0/8"}, "127.0.0.1"},
+	} {
+		serverOpts := *DefaultOptions
+		serverOpts.TrustedProxies = c.proxies
+		acceptor := listenWebsocket(t, &serverOpts)
+
+		_, port, _ := net.SplitHostPort(acceptor.httpServer.Addr)
+		options, err := transport.ParseOptions(context.Background(), "ws://"+net.JoinHostPort("127.0.0.1", port)+"/ws",
+			WithHeader(http.Header{"X-Forwarded-For": {"198.51.100.1"}}))
+		if err != nil {
+			t.Fatalf("parse options error: %v", err)
+		}
+		client, err := New().Connect(options)
+		if err != nil {
+			t.Fatalf("connect error: %v", err)
+		}
+		defer client.Close()
+
+		server, err := acceptor.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+		defer server.Close()
+
+		remote, request := server.RemoteAddr().String(), server.(Transport).Request().RemoteAddr
+		if c.want == "127.0.0.1" {
+			if host, _, _ := net.SplitHostPort(remote); host != c.want {
+				t.Fatalf("%v: unexpected remote addr %s", c.proxies, remote)
+			}
+		} else if remote != c.want || request != c.want {
+			t.Fatalf("%v: unexpected remote addr %s, request %s", c.proxies, remote, request)
+		}
+	}
+}
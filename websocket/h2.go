@@ -0,0 +1,511 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Websocket over HTTP/2 (RFC 8441): the client opens a stream with an extended
+// CONNECT request and the frames are carried by its DATA frames, so the
+// websocket channels to a server share one connection.
+//
+// The http2 package accepts extended CONNECT on the server side only when the
+// process is started with GODEBUG=http2xconnect=1. Over HTTP/3 (RFC 9220) the
+// wss channels share a QUIC connection the same way, see listenHTTP3.
+
+var (
+	errExtendedConnect = errors.New("websocket: Options.HTTP2 requires GODEBUG=http2xconnect=1")
+	errStreamDial      = errors.New("websocket: HTTP/2 and HTTP/3 are not dialed through Options.Proxy or Dialer.NetDial")
+)
+
+// aLongTimeAgo is a deadline in the past.
+var aLongTimeAgo = time.Unix(1, 0)
+
+const (
+	headerSecVersion    = "Sec-WebSocket-Version"
+	headerSecExtensions = "Sec-WebSocket-Extensions"
+	headerProtocol      = ":protocol"
+)
+
+// isExtendedConnect reports whether the request opens a websocket stream, the
+// :protocol of HTTP/3 requests is reported as their Proto.
+func isExtendedConnect(request *http.Request) bool {
+	if http.MethodConnect != request.Method {
+		return false
+	}
+	switch request.ProtoMajor {
+	case 2:
+		return "websocket" == request.Header.Get(headerProtocol)
+	case 3:
+		return "websocket" == request.Proto
+	}
+	return false
+}
+
+// extendedConnect reports whether GODEBUG lets the http2 server accept
+// extended CONNECT, the last http2xconnect setting wins.
+func extendedConnect() bool {
+	enabled := false
+	for _, setting := range strings.Split(os.Getenv("GODEBUG"), ",") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(setting), "http2xconnect="); ok {
+			enabled = "1" == value
+		}
+	}
+	return enabled
+}
+
+// configureHTTP2 serves HTTP/2 on the server, negotiated with ALPN on TLS or
+// with prior knowledge (h2c) on plain connections.
+func configureHTTP2(server *http.Server, secure bool) error {
+	if !extendedConnect() {
+		return errExtendedConnect
+	}
+	if secure {
+		return http2.ConfigureServer(server, &http2.Server{})
+	}
+	server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+	return nil
+}
+
+// upgradeStream answers the extended CONNECT request with the handshake of
+// upgrader and returns the stream as the websocket connection.
+func upgradeStream(upgrader ws.HTTPUpgrader, writer http.ResponseWriter, request *http.Request) (*streamConn, ws.Handshake, error) {
+
+	var hs ws.Handshake
+
+	if "13" != request.Header.Get(headerSecVersion) {
+		writer.Header().Set(headerSecVersion, "13")
+		http.Error(writer, ws.ErrHandshakeUpgradeRequired.Error(), http.StatusUpgradeRequired)
+		return nil, hs, ws.ErrHandshakeUpgradeRequired
+	}
+
+	if check := upgrader.Protocol; nil != check {
+		for _, protocol := range offeredProtocols(request) {
+			if check(protocol) {
+				hs.Protocol = protocol
+				break
+			}
+		}
+	}
+
+	if negotiate := upgrader.Negotiate; nil != negotiate {
+		for _, value := range request.Header.Values(headerSecExtensions) {
+			offers, ok := httphead.ParseOptions([]byte(value), nil)
+			if !ok {
+				http.Error(writer, ws.ErrMalformedRequest.Error(), http.StatusBadRequest)
+				return nil, hs, ws.ErrMalformedRequest
+			}
+			for _, offer := range offers {
+				accepted, err := negotiate(offer)
+				if nil != err {
+					http.Error(writer, err.Error(), http.StatusBadRequest)
+					return nil, hs, err
+				}
+				if accepted.Size() > 0 {
+					hs.Extensions = append(hs.Extensions, accepted.Clone())
+				}
+			}
+		}
+	}
+
+	header := writer.Header()
+	for key, values := range upgrader.Header {
+		header[key] = values
+	}
+	if "" != hs.Protocol {
+		header.Set(headerSecProtocol, hs.Protocol)
+	}
+	if len(hs.Extensions) > 0 {
+		var extensions bytes.Buffer
+		httphead.WriteOptions(&extensions, hs.Extensions)
+		header.Set(headerSecExtensions, extensions.String())
+	}
+
+	control := http.NewResponseController(writer)
+	if 0 != upgrader.Timeout {
+		_ = control.SetWriteDeadline(time.Now().Add(upgrader.Timeout))
+	}
+
+	writer.WriteHeader(http.StatusOK)
+	if err := control.Flush(); nil != err {
+		return nil, hs, err
+	}
+	_ = control.SetWriteDeadline(time.Time{})
+
+	network := "tcp"
+	if 3 == request.ProtoMajor {
+		network = "udp"
+	}
+	local, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if nil == local {
+		local = streamAddr{network: network}
+	}
+
+	return &streamConn{
+		body:     request.Body,
+		writer:   writer,
+		flush:    control.Flush,
+		control:  control,
+		local:    local,
+		remote:   streamAddr{network: network, address: request.RemoteAddr},
+		tlsState: request.TLS,
+		done:     make(chan struct{}),
+	}, hs, nil
+}
+
+// streamClient dials websocket streams, each one keeps a connection per server
+// for the streams of its channels.
+type streamClient struct {
+	tlsConfig *tls.Config
+	secure    *http2.Transport // wss, negotiated with ALPN
+	plain     *http2.Transport // ws, h2c with prior knowledge
+	quic      *http3.Transport // wss over HTTP/3
+}
+
+func newStreamClient(config *tls.Config) *streamClient {
+	return &streamClient{
+		tlsConfig: config,
+		secure:    &http2.Transport{TLSClientConfig: config},
+		quic:      &http3.Transport{TLSClientConfig: config},
+		plain: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+// dial opens a websocket stream to u with the protocols, extensions and
+// headers of dialer, the response is returned along with the stream.
+func (c *streamClient) dial(ctx context.Context, dialer ws.Dialer, u *url.URL, header http.Header, overQUIC bool) (*streamConn, *http.Response, ws.Handshake, error) {
+
+	var hs ws.Handshake
+
+	target := *u
+	target.Scheme = "http"
+	network, transport := "tcp", http.RoundTripper(c.plain)
+	switch {
+	case overQUIC:
+		target.Scheme, network, transport = "https", "udp", c.quic
+	case "wss" == u.Scheme:
+		target.Scheme, transport = "https", c.secure
+	}
+
+	requestHeader := make(http.Header)
+	for _, h := range []http.Header{header, handshakeHeader(dialer.Header)} {
+		for key, values := range h {
+			requestHeader[key] = append(requestHeader[key], values...)
+		}
+	}
+	if !overQUIC {
+		requestHeader.Set(headerProtocol, "websocket")
+	}
+	requestHeader.Set(headerSecVersion, "13")
+	if len(dialer.Protocols) > 0 {
+		requestHeader.Set(headerSecProtocol, strings.Join(dialer.Protocols, ", "))
+	}
+	if len(dialer.Extensions) > 0 {
+		var extensions bytes.Buffer
+		httphead.WriteOptions(&extensions, dialer.Extensions)
+		requestHeader.Set(headerSecExtensions, extensions.String())
+	}
+
+	// the context lives as long as the stream, it is canceled by Close
+	ctx, cancel := context.WithCancel(ctx)
+
+	var local, remote net.Addr
+	var tlsState *tls.ConnectionState
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			local, remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+			tlsState = connectionState(info.Conn)
+		},
+	})
+
+	reader, writer := io.Pipe()
+	request, err := http.NewRequestWithContext(ctx, http.MethodConnect, target.String(), reader)
+	if nil != err {
+		cancel()
+		return nil, nil, hs, err
+	}
+	request.Header = requestHeader
+	if overQUIC {
+		request.Proto = "websocket"
+	}
+
+	var timer *time.Timer
+	if dialer.Timeout > 0 {
+		timer = time.AfterFunc(dialer.Timeout, cancel)
+	}
+
+	response, err := transport.RoundTrip(request)
+	if nil == err && nil != timer && !timer.Stop() {
+		// timed out along with the response
+		_ = response.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if nil != err {
+		cancel()
+		_ = writer.Close()
+		return nil, nil, hs, err
+	}
+
+	closeStream := func() {
+		_ = writer.Close()
+		_ = response.Body.Close()
+		cancel()
+	}
+
+	if http.StatusOK != response.StatusCode {
+		closeStream()
+		return nil, nil, hs, ws.StatusError(response.StatusCode)
+	}
+
+	if hs.Protocol = response.Header.Get(headerSecProtocol); "" != hs.Protocol && !containsProtocol(dialer.Protocols, hs.Protocol) {
+		closeStream()
+		return nil, nil, hs, ws.ErrHandshakeBadSubProtocol
+	}
+
+	for _, value := range response.Header.Values(headerSecExtensions) {
+		accepted, ok := httphead.ParseOptions([]byte(value), nil)
+		if !ok || !offeredExtensions(dialer.Extensions, accepted) {
+			closeStream()
+			return nil, nil, hs, ws.ErrHandshakeBadExtensions
+		}
+		hs.Extensions = append(hs.Extensions, accepted...)
+	}
+
+	if nil == local {
+		local, remote = streamAddr{network: network}, streamAddr{network: network, address: target.Host}
+	}
+	if nil == tlsState {
+		tlsState = response.TLS
+	}
+	request.RemoteAddr = remote.String()
+	response.Request = request
+
+	return &streamConn{
+		body:     response.Body,
+		writer:   writer,
+		local:    local,
+		remote:   remote,
+		tlsState: tlsState,
+		done:     make(chan struct{}),
+		release:  closeStream,
+	}, response, hs, nil
+}
+
+// connectStream dials the websocket on an HTTP/2 stream.
+func connectStream(ctx context.Context, options *Options, dialer ws.Dialer, u *url.URL, header http.Header) (*websocketTransport, error) {
+
+	client := options.streamClient
+	if nil == client {
+		client = newStreamClient(options.TLS)
+	}
+
+	conn, response, hs, err := client.dial(ctx, dialer, u, header, options.HTTP3)
+	if nil != err {
+		return nil, err
+	}
+
+	tt, err := newWebsocketTransport(conn, options, true, response.Request, hs)
+	if nil != err {
+		_ = conn.Close()
+		return nil, err
+	}
+	tt.response = response
+	return tt, nil
+}
+
+// handshakeHeader returns the headers written by h.
+func handshakeHeader(h ws.HandshakeHeader) http.Header {
+	switch t := h.(type) {
+	case nil:
+		return nil
+	case ws.HandshakeHeaderHTTP:
+		return http.Header(t)
+	}
+
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); nil != err {
+		return nil
+	}
+	buf.WriteString("\r\n")
+
+	header, _ := textproto.NewReader(bufio.NewReader(&buf)).ReadMIMEHeader()
+	return http.Header(header)
+}
+
+func containsProtocol(protocols []string, protocol string) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// offeredExtensions reports whether the accepted extensions were offered.
+func offeredExtensions(offered, accepted []httphead.Option) bool {
+	for _, a := range accepted {
+		found := false
+		for _, o := range offered {
+			if bytes.Equal(a.Name, o.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// streamConn is a websocket connection carried by an HTTP/2 stream.
+type streamConn struct {
+	body     io.ReadCloser
+	writer   io.Writer
+	flush    func() error             // server side
+	control  *http.ResponseController // server side
+	release  func()                   // client side
+	local    net.Addr
+	remote   net.Addr
+	tlsState *tls.ConnectionState
+	// writes are done before the handler of a server stream returns
+	locker sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (n int, err error) {
+	c.locker.RLock()
+	defer c.locker.RUnlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	if n, err = c.writer.Write(p); nil == err && nil != c.flush {
+		err = c.flush()
+	}
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	// unblock the pending read and write
+	_ = c.body.Close()
+	if closer, ok := c.writer.(io.Closer); ok {
+		_ = closer.Close()
+	} else if nil != c.control {
+		_ = c.control.SetWriteDeadline(aLongTimeAgo)
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+
+	if nil != c.release {
+		c.release()
+	}
+	close(c.done)
+	return nil
+}
+
+// wait blocks the handler of a server stream until the stream is closed.
+func (c *streamConn) wait(ctx context.Context) {
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		// reset by the client
+		_ = c.Close()
+	}
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); nil != err {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if nil == c.control {
+		return os.ErrNoDeadline
+	}
+	return c.control.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if nil == c.control {
+		return os.ErrNoDeadline
+	}
+	return c.control.SetWriteDeadline(t)
+}
+
+// streamAddr is the address of the connection carrying a stream.
+type streamAddr struct {
+	network string
+	address string
+}
+
+func (a streamAddr) Network() string {
+	return a.network
+}
+
+func (a streamAddr) String() string {
+	return a.address
+}
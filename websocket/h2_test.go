@@ -0,0 +1,228 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+// runWithExtendedConnect runs the test again in a child process with extended
+// CONNECT enabled, the http2 package reads GODEBUG once at init. It returns
+// false in the child process.
+func runWithExtendedConnect(t *testing.T) bool {
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, "http2xconnect=1") {
+		return false
+	}
+	if "" != godebug {
+		godebug += ","
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.count=1")
+	cmd.Env = append(os.Environ(), "GODEBUG="+godebug+"http2xconnect=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v", out, err)
+	}
+	return true
+}
+
+func roundTrip(t *testing.T, from, to Transport, payload string) {
+	t.Helper()
+	if _, err := from.WriteMessage(ws.OpText, []byte(payload)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if err := from.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	got, err := io.ReadAll(readerFunc(to.Read))
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(got) != payload {
+		t.Fatalf("unexpected message: %q, want %q", got, payload)
+	}
+}
+
+func TestHTTP2_ExtendedConnect(t *testing.T) {
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	opts := *DefaultOptions
+	opts.HTTP2 = true
+	opts.CompressEnabled = true
+	opts.CompressThreshold = 0
+	opts.Protocols = []string{"chat"}
+	acceptor := listenWebsocket(t, &opts)
+	url := "ws://" + acceptor.httpServer.Addr + "/ws"
+
+	clientOpts := opts
+	var remotes []string
+	for _, payload := range []string{"first channel", "second channel"} {
+		client, err := connectWebsocket(t, url, &clientOpts)
+		if err != nil {
+			t.Fatalf("connect error: %v", err)
+		}
+		server, err := acceptor.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+		defer server.Close()
+
+		request := server.(Transport).Request()
+		if request.ProtoMajor != 2 || request.Method != "CONNECT" {
+			t.Fatalf("unexpected request: %s %s", request.Method, request.Proto)
+		}
+		if client.Response().StatusCode != 200 || client.Subprotocol() != "chat" || !client.negotiated.enabled {
+			t.Fatalf("unexpected handshake: %d, %q, compress %v", client.Response().StatusCode, client.Subprotocol(), client.negotiated.enabled)
+		}
+
+		roundTrip(t, client, server.(Transport), payload)
+		roundTrip(t, server.(Transport), client, payload+" reply")
+		remotes = append(remotes, server.RemoteAddr().String())
+	}
+
+	// both streams are carried by one connection
+	if remotes[0] != remotes[1] {
+		t.Fatalf("expected a shared connection, got %v", remotes)
+	}
+
+	// HTTP/1.1 upgrades are still served
+	client, err := connectWebsocket(t, url, DefaultOptions)
+	if err != nil {
+		t.Fatalf("connect http/1.1 error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+	roundTrip(t, client, server.(Transport), "http/1.1")
+}
+
+func TestHTTP2_CloseEndsStream(t *testing.T) {
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	opts := *DefaultOptions
+	opts.HTTP2 = true
+	acceptor := listenWebsocket(t, &opts)
+
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", &opts)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	// the close frames are received by the read loops
+	readErr := func(read readerFunc) chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.ReadAll(read)
+			done <- err
+		}()
+		return done
+	}
+	serverErr, clientErr := readErr(server.Read), readErr(client.Read)
+
+	start := time.Now()
+	if err = client.GracefulClose(int(ws.StatusNormalClosure), "bye"); err != nil {
+		t.Fatalf("graceful close error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("close handshake took %v", elapsed)
+	}
+	if err = <-serverErr; err == nil {
+		t.Fatalf("expected the close frame")
+	}
+	<-clientErr
+	_ = server.Close()
+	if _, err = server.Write([]byte("late")); err == nil {
+		t.Fatalf("expected write on a closed stream to fail")
+	}
+}
+
+func TestHTTP2_TLS(t *testing.T) {
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	cert, pool := newTestCertificate(t, "server", x509.ExtKeyUsageServerAuth)
+
+	serverOpts := *DefaultOptions
+	serverOpts.HTTP2 = true
+	serverOpts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	options, err := transport.ParseOptions(context.Background(), "wss://127.0.0.1:0/ws", WithOptions(&serverOpts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	acceptor, err := New().Listen(options)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer acceptor.Close()
+	_, port, _ := net.SplitHostPort(acceptor.(*wsAcceptor).httpServer.Addr)
+
+	clientOpts := *DefaultOptions
+	clientOpts.HTTP2 = true
+	clientOpts.TLS = &tls.Config{RootCAs: pool}
+	client, err := connectWebsocket(t, "wss://"+net.JoinHostPort("127.0.0.1", port)+"/ws", &clientOpts)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	if state := client.TLS(); state == nil || state.NegotiatedProtocol != "h2" {
+		t.Fatalf("unexpected client tls state: %+v", state)
+	}
+	if state := server.(Transport).TLS(); state == nil || state.NegotiatedProtocol != "h2" {
+		t.Fatalf("unexpected server tls state: %+v", state)
+	}
+	roundTrip(t, client, server.(Transport), "over tls")
+}
+
+func TestHTTP2_RequiresExtendedConnect(t *testing.T) {
+	t.Setenv("GODEBUG", "http2xconnect=1,http2xconnect=0")
+
+	opts := *DefaultOptions
+	opts.HTTP2 = true
+	options, err := transport.ParseOptions(context.Background(), "ws://127.0.0.1:0/ws", WithOptions(&opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	if _, err = New().Listen(options); err != errExtendedConnect {
+		t.Fatalf("unexpected listen error: %v", err)
+	}
+}
+
+func TestHTTP2_RefusesProxy(t *testing.T) {
+	opts := *DefaultOptions
+	opts.HTTP2 = true
+	opts.Proxy = ProxyURL(&url.URL{Scheme: "http", Host: "127.0.0.1:3128"})
+	options, err := transport.ParseOptions(context.Background(), "ws://127.0.0.1:8080/ws", WithOptions(&opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	if _, err = New().Connect(options); err != errStreamDial {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+}
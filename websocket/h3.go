@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+var errHTTP3Scheme = errors.New("websocket: HTTP/3 requires the wss scheme")
+
+// listenHTTP3 binds the UDP port of addr to serve the wss routes over HTTP/3,
+// the server accepts extended CONNECT (RFC 9220) by default.
+func listenHTTP3(addr net.Addr, handler http.Handler, options *Options) (*http3.Server, net.PacketConn, error) {
+
+	conn, err := net.ListenPacket("udp", addr.String())
+	if nil != err {
+		return nil, nil, err
+	}
+
+	server := &http3.Server{
+		Handler:        handler,
+		TLSConfig:      http3.ConfigureTLSConfig(options.TLS),
+		MaxHeaderBytes: options.MaxHeaderBytes,
+		IdleTimeout:    options.HTTPIdleTimeout,
+	}
+	return server, conn, nil
+}
+
+// closeHTTP3 closes the HTTP/3 server, its streams are aborted.
+func (w *wsAcceptor) closeHTTP3() error {
+	if nil == w.http3Server {
+		return nil
+	}
+	err := w.http3Server.Close()
+	// the server does not close the connection it serves
+	if cerr := w.packetConn.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+// shutdownHTTP3 waits for the streams of the HTTP/3 server to end.
+func (w *wsAcceptor) shutdownHTTP3(ctx context.Context) error {
+	if nil == w.http3Server {
+		return nil
+	}
+	err := w.http3Server.Shutdown(ctx)
+	if cerr := w.packetConn.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/go-netty/go-netty/transport"
+)
+
+func TestHTTP3_ExtendedConnect(t *testing.T) {
+	cert, pool := newTestCertificate(t, "server", x509.ExtKeyUsageServerAuth)
+
+	serverOpts := *DefaultOptions
+	serverOpts.HTTP3 = true
+	serverOpts.CompressEnabled = true
+	serverOpts.CompressThreshold = 0
+	serverOpts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	options, err := transport.ParseOptions(context.Background(), "wss://127.0.0.1:0/ws", WithOptions(&serverOpts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	acceptor, err := New().Listen(options)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer acceptor.Close()
+	_, port, _ := net.SplitHostPort(acceptor.(*wsAcceptor).httpServer.Addr)
+	url := "wss://" + net.JoinHostPort("127.0.0.1", port) + "/ws"
+
+	clientOpts := *DefaultOptions
+	clientOpts.HTTP3 = true
+	clientOpts.CompressEnabled = true
+	clientOpts.TLS = &tls.Config{RootCAs: pool}
+
+	var remotes []string
+	for _, payload := range []string{"first channel", "second channel"} {
+		client, err := connectWebsocket(t, url, &clientOpts)
+		if err != nil {
+			t.Fatalf("connect error: %v", err)
+		}
+		server, err := acceptor.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+		defer server.Close()
+
+		request := server.(Transport).Request()
+		if request.ProtoMajor != 3 || request.Method != "CONNECT" {
+			t.Fatalf("unexpected request: %s %s", request.Method, request.Proto)
+		}
+		if !client.negotiated.enabled {
+			t.Fatalf("expected compression to be negotiated")
+		}
+		if state := client.TLS(); state == nil || state.NegotiatedProtocol != "h3" {
+			t.Fatalf("unexpected client tls state: %+v", state)
+		}
+		if state := server.(Transport).TLS(); state == nil || state.NegotiatedProtocol != "h3" {
+			t.Fatalf("unexpected server tls state: %+v", state)
+		}
+
+		roundTrip(t, client, server.(Transport), payload)
+		roundTrip(t, server.(Transport), client, payload+" reply")
+		if network := server.RemoteAddr().Network(); network != "udp" {
+			t.Fatalf("unexpected remote network: %s", network)
+		}
+		remotes = append(remotes, server.RemoteAddr().String())
+	}
+
+	// both streams are carried by one QUIC connection
+	if remotes[0] != remotes[1] {
+		t.Fatalf("expected a shared connection, got %v", remotes)
+	}
+
+	// the live streams are aborted
+	if err = acceptor.Close(); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+}
+
+func TestHTTP3_RequiresWSS(t *testing.T) {
+	opts := *DefaultOptions
+	opts.HTTP3 = true
+	options, err := transport.ParseOptions(context.Background(), "ws://127.0.0.1:0/ws", WithOptions(&opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	if _, err = New().Listen(options); err != errHTTP3Scheme {
+		t.Fatalf("unexpected listen error: %v", err)
+	}
+	if _, err = New().Connect(options); err != errHTTP3Scheme {
+		t.Fatalf("unexpected connect error: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package wsutils
 
 import (
+	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -38,23 +39,34 @@ func (c *CipherReader) Read(p []byte) (int, error) {
 
 // FastCipher in-place xors p with mask, starting at offset.
 func FastCipher(p []byte, mask [4]byte, off int) {
-	if len(p) == 0 {
+	CipherCopy(p, p, mask, off)
+}
+
+// CipherCopy writes src xored with mask, starting at offset, into dst, which
+// must be at least as long as src. The bytes are xored 8 at a time.
+func CipherCopy(dst, src []byte, mask [4]byte, off int) {
+	if len(src) == 0 {
 		return
 	}
+	dst = dst[:len(src)]
+
 	var i int
-	for ; i < len(p) && (off&3) != 0; i++ {
-		p[i] ^= mask[off&3]
+	for ; i < len(src) && (off&3) != 0; i++ {
+		dst[i] = src[i] ^ mask[off&3]
 		off++
 	}
-	for ; i+4 <= len(p); i += 4 {
-		p[i] ^= mask[0]
-		p[i+1] ^= mask[1]
-		p[i+2] ^= mask[2]
-		p[i+3] ^= mask[3]
+
+	if len(src)-i >= 8 {
+		m := uint64(binary.LittleEndian.Uint32(mask[:]))
+		m |= m << 32
+		for ; i+8 <= len(src); i += 8 {
+			binary.LittleEndian.PutUint64(dst[i:], binary.LittleEndian.Uint64(src[i:])^m)
+		}
 	}
-	for ; i < len(p); i++ {
-		p[i] ^= mask[off&3]
-		off++
+
+	// the mask is aligned again after whole words
+	for j := 0; i < len(src); i, j = i+1, j+1 {
+		dst[i] = src[i] ^ mask[j&3]
 	}
 }
 
@@ -65,6 +77,13 @@ type ControlHandler struct {
 	State               ws.State
 	WriterLocker        sync.Locker
 	DisableSrcCiphering bool
+	OnPong              func(payload []byte)
+	// OnPing takes over the pong reply when set, so the reader does not wait
+	// for the writer. The payload is only valid until it returns.
+	OnPing func(payload []byte)
+	// OnClose is called when a close frame is received, the frame is echoed
+	// unless it returns false.
+	OnClose func(code ws.StatusCode, reason string) bool
 }
 
 func (c ControlHandler) Handle(h ws.Header) error {
@@ -80,10 +99,22 @@ func (c ControlHandler) Handle(h ws.Header) error {
 }
 
 func (c ControlHandler) HandlePing(h ws.Header) error {
+	if c.OnPing != nil {
+		buf := pbytes.Get(int(h.Length))
+		defer pbytes.Put(buf)
+		if _, err := io.ReadFull(c.Src, (*buf)[:h.Length]); err != nil {
+			return err
+		}
+		c.OnPing((*buf)[:h.Length])
+		return nil
+	}
 	if h.Length == 0 {
 		c.WriterLocker.Lock()
 		defer c.WriterLocker.Unlock()
-		return ws.WriteHeader(c.Dst, ws.Header{Fin: true, OpCode: ws.OpPong, Masked: c.State.ClientSide()})
+		if err := ws.WriteHeader(c.Dst, ws.Header{Fin: true, OpCode: ws.OpPong, Masked: c.State.ClientSide()}); err != nil {
+			return err
+		}
+		return c.flushDst()
 	}
 	bufSize := int(h.Length) + ws.HeaderSize(ws.Header{Length: h.Length, Masked: c.State.ClientSide()})
 	p := pbytes.Get(bufSize)
@@ -101,26 +132,56 @@ func (c ControlHandler) HandlePing(h ws.Header) error {
 	if err == nil {
 		err = w.Flush()
 	}
+	if err == nil {
+		err = c.flushDst()
+	}
 	return err
 }
 
+// flushDst flushes the destination if it is buffered, so that replies are not
+// delayed until the next data write.
+func (c ControlHandler) flushDst() error {
+	if f, ok := c.Dst.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 func (c ControlHandler) HandlePong(h ws.Header) error {
 	if h.Length == 0 {
+		if c.OnPong != nil {
+			c.OnPong(nil)
+		}
 		return nil
 	}
 	buf := pbytes.Get(int(h.Length))
 	defer pbytes.Put(buf)
-	_, err := io.CopyBuffer(ioutil.Discard, c.Src, (*buf)[:h.Length])
-	return err
+	if c.OnPong == nil {
+		_, err := io.CopyBuffer(ioutil.Discard, c.Src, (*buf)[:h.Length])
+		return err
+	}
+	r := c.Src
+	if c.State.ServerSide() && !c.DisableSrcCiphering {
+		r = wsutil.NewCipherReader(r, h.Mask)
+	}
+	if _, err := io.ReadFull(r, (*buf)[:h.Length]); err != nil {
+		return err
+	}
+	c.OnPong((*buf)[:h.Length])
+	return nil
 }
 
 func (c ControlHandler) HandleClose(h ws.Header) error {
 	if h.Length == 0 {
+		if c.OnClose != nil && !c.OnClose(ws.StatusNoStatusRcvd, "") {
+			return wsutil.ClosedError{Code: ws.StatusNoStatusRcvd}
+		}
 		c.WriterLocker.Lock()
 		defer c.WriterLocker.Unlock()
-		err := ws.WriteHeader(c.Dst, ws.Header{Fin: true, OpCode: ws.OpClose, Masked: c.State.ClientSide()})
-		if err != nil {
-			return err
+		// the peer's close frame is reported even if the echo fails, the
+		// connection is closing anyway.
+		if err := ws.WriteHeader(c.Dst, ws.Header{Fin: true, OpCode: ws.OpClose, Masked: c.State.ClientSide()}); err == nil {
+			_ = c.flushDst()
 		}
 		return wsutil.ClosedError{Code: ws.StatusNoStatusRcvd}
 	}
@@ -140,15 +201,16 @@ func (c ControlHandler) HandleClose(h ws.Header) error {
 		c.closeWithProtocolError(err)
 		return err
 	}
+	if c.OnClose != nil && !c.OnClose(code, reason) {
+		return wsutil.ClosedError{Code: code, Reason: reason}
+	}
 	c.WriterLocker.Lock()
 	defer c.WriterLocker.Unlock()
 	w := wsutil.NewControlWriterBuffer(c.Dst, c.State, ws.OpClose, (*p)[:bufSize])
-	_, err := w.Write((*p)[:2])
-	if err != nil {
-		return err
-	}
-	if err := w.Flush(); err != nil {
-		return err
+	if _, err := w.Write((*p)[:2]); err == nil {
+		if err = w.Flush(); err == nil {
+			_ = c.flushDst()
+		}
 	}
 	return wsutil.ClosedError{Code: code, Reason: reason}
 }
@@ -163,8 +225,13 @@ func (c ControlHandler) closeWithProtocolError(reason error) error {
 	return ws.WriteFrame(c.Dst, f)
 }
 
-func ControlFrameHandler(w io.Writer, wlock sync.Locker, state ws.State) wsutil.FrameHandlerFunc {
+// ControlFrameHandler returns a frame handler that handles control frames with a
+// copy of handler reading from the frame payload, which is already unmasked.
+func ControlFrameHandler(handler ControlHandler) wsutil.FrameHandlerFunc {
+	handler.DisableSrcCiphering = true
 	return func(h ws.Header, r io.Reader) error {
-		return (ControlHandler{DisableSrcCiphering: true, Src: r, Dst: w, WriterLocker: wlock, State: state}).Handle(h)
+		c := handler
+		c.Src = r
+		return c.Handle(h)
 	}
 }
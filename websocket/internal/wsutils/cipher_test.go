@@ -0,0 +1,137 @@
+package wsutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// cipherBytewise is the reference implementation xoring one byte at a time.
+func cipherBytewise(p []byte, mask [4]byte, off int) {
+	for i := range p {
+		p[i] ^= mask[(off+i)&3]
+	}
+}
+
+func TestCipherCopy(t *testing.T) {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	src := make([]byte, 67)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	for off := 0; off < 4; off++ {
+		for n := 0; n <= len(src); n++ {
+			want := append([]byte(nil), src[:n]...)
+			cipherBytewise(want, mask, off)
+
+			dst := make([]byte, n)
+			CipherCopy(dst, src[:n], mask, off)
+			if !bytes.Equal(dst, want) {
+				t.Fatalf("off %d, len %d: got %x, want %x", off, n, dst, want)
+			}
+
+			inPlace := append([]byte(nil), src[:n]...)
+			FastCipher(inPlace, mask, off)
+			if !bytes.Equal(inPlace, want) {
+				t.Fatalf("in place off %d, len %d: got %x, want %x", off, n, inPlace, want)
+			}
+		}
+	}
+}
+
+func TestCipherReader(t *testing.T) {
+	mask := [4]byte{1, 2, 3, 4}
+	payload := bytes.Repeat([]byte("masked-payload;"), 100)
+	masked := append([]byte(nil), payload...)
+	FastCipher(masked, mask, 0)
+
+	// odd sized reads keep the mask offset across calls
+	r := NewCipherReader(&oddReader{r: bytes.NewReader(masked)}, mask)
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected payload: %q", got)
+	}
+}
+
+type oddReader struct {
+	r io.Reader
+	n int
+}
+
+func (o *oddReader) Read(p []byte) (int, error) {
+	o.n = o.n%7 + 1
+	if len(p) > o.n {
+		p = p[:o.n]
+	}
+	return o.r.Read(p)
+}
+
+var benchSizes = []int{16, 128, 1024, 32 * 1024}
+
+func BenchmarkCipher(b *testing.B) {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for _, size := range benchSizes {
+		src := make([]byte, size)
+		dst := make([]byte, size)
+
+		b.Run(fmt.Sprintf("bytewise/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				copy(dst, src)
+				cipherBytewise(dst, mask, 0)
+			}
+		})
+
+		b.Run(fmt.Sprintf("word/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				CipherCopy(dst, src, mask, 0)
+			}
+		})
+	}
+}
+
+// bytewiseCipherReader unmasks with the reference implementation.
+type bytewiseCipherReader struct {
+	r   io.Reader
+	m   [4]byte
+	pos int
+}
+
+func (c *bytewiseCipherReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	cipherBytewise(p[:n], c.m, c.pos)
+	c.pos = (c.pos + n) & 3
+	return n, err
+}
+
+func BenchmarkCipherReader(b *testing.B) {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for _, size := range benchSizes {
+		src := bytes.NewReader(make([]byte, size))
+		buf := make([]byte, size)
+
+		b.Run(fmt.Sprintf("bytewise/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			r := &bytewiseCipherReader{r: src, m: mask}
+			for i := 0; i < b.N; i++ {
+				src.Seek(0, io.SeekStart)
+				_, _ = io.ReadFull(r, buf)
+			}
+		})
+
+		b.Run(fmt.Sprintf("word/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			r := NewCipherReader(src, mask)
+			for i := 0; i < b.N; i++ {
+				src.Seek(0, io.SeekStart)
+				_, _ = io.ReadFull(r, buf)
+			}
+		})
+	}
+}
@@ -11,10 +11,10 @@ var (
 	compressionTail = [4]byte{0, 0, 0xff, 0xff}
 	// compressionReadTail must provide bytes appended to the raw DEFLATE
 	// stream so the decompressor can finish properly. The canonical tail
-	// for a sync-flush raw DEFLATE block is 0x00 0x00 0xff 0xff (4 bytes).
-	// Using a longer/incorrect suffix may confuse the inflater and lead to
-	// protocol errors (close 1002). Keep it 4 bytes to match expectations.
-	compressionReadTail = [4]byte{0, 0, 0xff, 0xff}
+	// for a sync-flush raw DEFLATE block is 0x00 0x00 0xff 0xff, followed by
+	// an empty final stored block so the inflater reports io.EOF at the end
+	// of the message instead of io.ErrUnexpectedEOF.
+	compressionReadTail = [9]byte{0, 0, 0xff, 0xff, 1, 0, 0, 0xff, 0xff}
 )
 
 // Decompressor is alias for wsflate decompressor.
@@ -35,6 +35,10 @@ type FlateReader struct {
 	d    Decompressor
 	sr   suffixedReader
 	err  error
+	// window keeps the recent output as the dictionary of the next message
+	// when context takeover is enabled.
+	takeover bool
+	window   []byte
 }
 
 // NewFlateReader returns a new FlateReader.
@@ -54,7 +58,7 @@ func (r *FlateReader) Reset(src io.Reader) {
 	r.src = src
 	r.sr.reset(src)
 	if x, ok := r.d.(ReadResetter); ok {
-		x.Reset(r.sr.iface(), nil)
+		x.Reset(r.sr.iface(), r.dictionary())
 	} else {
 		r.d = r.ctor(r.sr.iface())
 	}
@@ -65,7 +69,39 @@ func (r *FlateReader) Read(p []byte) (int, error) {
 	if r.err != nil {
 		return 0, r.err
 	}
-	return r.d.Read(p)
+	n, err := r.d.Read(p)
+	if r.takeover && n > 0 {
+		r.keep(p[:n])
+	}
+	return n, err
+}
+
+// SetContextTakeover makes Reset keep the output of previous messages as the
+// dictionary of the next one, disabling it drops the kept output.
+func (r *FlateReader) SetContextTakeover(enabled bool) {
+	r.takeover = enabled
+	r.window = r.window[:0]
+}
+
+func (r *FlateReader) dictionary() []byte {
+	if n := len(r.window); n > wsflate.MaxLZ77WindowSize {
+		return r.window[n-wsflate.MaxLZ77WindowSize:]
+	}
+	return r.window
+}
+
+// keep appends p to the window, which grows up to twice the LZ77 window size
+// before the older half is dropped.
+func (r *FlateReader) keep(p []byte) {
+	const size = wsflate.MaxLZ77WindowSize
+	if len(p) >= size {
+		r.window = append(r.window[:0], p[len(p)-size:]...)
+		return
+	}
+	if len(r.window)+len(p) > 2*size {
+		r.window = r.window[:copy(r.window, r.window[len(r.window)-size+len(p):])]
+	}
+	r.window = append(r.window, p...)
 }
 
 // Close closes underlying decompressor if closable.
@@ -94,6 +130,8 @@ type FlateWriter struct {
 	c    Compressor
 	cbuf cbuf
 	err  error
+	// takeover keeps the compressor state between messages.
+	takeover bool
 }
 
 // NewFlateWriter returns a new FlateWriter.
@@ -107,6 +145,10 @@ func NewFlateWriter(w io.Writer, ctor func(io.Writer) Compressor) *FlateWriter {
 func (w *FlateWriter) Reset(dest io.Writer) {
 	w.err = nil
 	w.cbuf.reset(dest)
+	if w.takeover && nil != w.c {
+		// the flushed stream continues with the next message
+		return
+	}
 	if x, ok := w.c.(WriteResetter); ok {
 		x.Reset(&w.cbuf)
 	} else {
@@ -150,6 +192,21 @@ func (w *FlateWriter) Close() error {
 
 func (w *FlateWriter) Err() error { return w.err }
 
+// SetContextTakeover makes Reset keep the compressor state, so the following
+// messages refer to the previous ones. Disabling it takes effect on the next Reset.
+func (w *FlateWriter) SetContextTakeover(enabled bool) {
+	w.takeover = enabled
+}
+
+// ResetContext drops the compressor state kept by context takeover, so the next
+// message refers to none of the previous ones.
+func (w *FlateWriter) ResetContext() {
+	takeover := w.takeover
+	w.takeover = false
+	w.Reset(nil)
+	w.takeover = takeover
+}
+
 func (w *FlateWriter) checkTail() {
 	if w.err == nil && w.cbuf.buf != compressionTail {
 		w.err = fmt.Errorf("wsflate: bad compressor: unexpected stream tail: %#x vs %#x", w.cbuf.buf, compressionTail)
@@ -210,7 +267,7 @@ func (c *cbuf) reset(dst io.Writer) {
 type suffixedReader struct {
 	r      io.Reader
 	pos    int
-	suffix [4]byte
+	suffix [9]byte
 	rx     struct{ io.Reader }
 }
 
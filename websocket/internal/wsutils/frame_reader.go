@@ -2,6 +2,7 @@ package wsutils
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +12,10 @@ import (
 	"github.com/gobwas/ws/wsutil"
 )
 
+// ErrMessageTooBig is returned when a message exceeds MaxMessageSize or
+// MaxDecompressedSize.
+var ErrMessageTooBig = errors.New("websocket: message too big")
+
 // FrameReader is adapted from internal xwsutil.Reader. Renamed to avoid
 // name collision and live inside websocket package.
 type FrameReader struct {
@@ -21,6 +26,10 @@ type FrameReader struct {
 	CheckUTF8       bool
 	Extensions      []wsutil.RecvExtension
 	MaxFrameSize    int64
+	// MaxMessageSize limits the payload of a message summed over its fragments,
+	// MaxDecompressedSize limits the inflated payload of a compressed message.
+	MaxMessageSize      int64
+	MaxDecompressedSize int64
 
 	OnContinuation wsutil.FrameHandlerFunc
 	OnIntermediate wsutil.FrameHandlerFunc
@@ -29,7 +38,11 @@ type FrameReader struct {
 	PutFlateReader func(reader *FlateReader)
 
 	opCode       ws.OpCode
+	compressed   bool
+	messageSize  int64 // payload bytes of the message so far
+	inflated     int64 // inflated bytes of the compressed message so far
 	frame        io.Reader
+	payload      io.Reader
 	raw          io.LimitedReader
 	utf8         wsutil.UTF8Reader
 	cipherReader *CipherReader
@@ -55,6 +68,23 @@ func (r *FrameReader) Read(p []byte) (n int, err error) {
 		}
 	}
 	n, err = r.frame.Read(p)
+	if r.compressed {
+		if r.inflated += int64(n); r.MaxDecompressedSize > 0 && r.inflated > r.MaxDecompressedSize {
+			return 0, ErrMessageTooBig
+		}
+		// the decompressor spans all fragments of the message, so only its
+		// io.EOF marks the end of the message.
+		switch {
+		case err != io.EOF:
+			return n, err
+		case r.CheckUTF8 && !r.utf8.Valid():
+			n = r.utf8.Accepted()
+			err = wsutil.ErrInvalidUTF8
+		default:
+			r.reset()
+		}
+		return n, err
+	}
 	if err != nil && err != io.EOF {
 		return n, err
 	}
@@ -79,6 +109,15 @@ func (r *FrameReader) Read(p []byte) (n int, err error) {
 }
 
 func (r *FrameReader) Discard() (err error) {
+	if r.compressed {
+		// inflate the rest of the message, a decompressor with context
+		// takeover needs the whole output as its dictionary.
+		if _, err = io.Copy(ioutil.Discard, r); err == nil {
+			return nil
+		}
+		r.reset()
+		return err
+	}
 	for {
 		_, err = io.Copy(ioutil.Discard, &r.raw)
 		if err != nil {
@@ -109,6 +148,11 @@ func (r *FrameReader) NextFrame() (hdr ws.Header, err error) {
 	if n := r.MaxFrameSize; n > 0 && hdr.Length > n {
 		return hdr, wsutil.ErrFrameTooLarge
 	}
+	if !hdr.OpCode.IsControl() {
+		if r.messageSize += hdr.Length; r.MaxMessageSize > 0 && r.messageSize > r.MaxMessageSize {
+			return hdr, ErrMessageTooBig
+		}
+	}
 
 	r.raw = io.LimitedReader{R: r.Source, N: hdr.Length}
 	frame := io.Reader(&r.raw)
@@ -121,6 +165,14 @@ func (r *FrameReader) NextFrame() (hdr ws.Header, err error) {
 		frame = r.cipherReader
 	}
 
+	// continuation of a compressed message, the decompressor reads the
+	// payload through compressedSource.
+	if r.compressed && hdr.OpCode == ws.OpContinuation {
+		r.payload = frame
+		r.setFragmented(hdr.Fin)
+		return hdr, nil
+	}
+
 	compressed, err := wsflate.IsCompressed(hdr)
 	switch {
 	case err != nil:
@@ -129,7 +181,9 @@ func (r *FrameReader) NextFrame() (hdr ws.Header, err error) {
 		if r.GetFlateReader == nil {
 			return hdr, fmt.Errorf("required `GetFlateReader`")
 		}
-		r.flateReader = r.GetFlateReader(frame)
+		r.compressed = true
+		r.payload = frame
+		r.flateReader = r.GetFlateReader(compressedSource{r})
 		frame = r.flateReader
 	}
 
@@ -164,16 +218,20 @@ func (r *FrameReader) NextFrame() (hdr ws.Header, err error) {
 			err = cb(hdr, frame)
 		}
 	}
-	if hdr.Fin {
+	r.setFragmented(hdr.Fin)
+	return hdr, err
+}
+
+func (r *FrameReader) fragmented() bool { return r.State.Fragmented() }
+
+func (r *FrameReader) setFragmented(fin bool) {
+	if fin {
 		r.State = r.State.Clear(ws.StateFragmented)
 	} else {
 		r.State = r.State.Set(ws.StateFragmented)
 	}
-	return hdr, err
 }
 
-func (r *FrameReader) fragmented() bool { return r.State.Fragmented() }
-
 func (r *FrameReader) resetFragment() {
 	r.raw = io.LimitedReader{}
 	r.frame = nil
@@ -186,8 +244,12 @@ func (r *FrameReader) resetFragment() {
 func (r *FrameReader) reset() {
 	r.raw = io.LimitedReader{}
 	r.frame = nil
+	r.payload = nil
 	r.utf8 = wsutil.UTF8Reader{}
 	r.opCode = 0
+	r.compressed = false
+	r.messageSize = 0
+	r.inflated = 0
 	if r.cipherReader != nil {
 		r.cipherReader.Reset(nil, [4]byte{})
 	}
@@ -199,6 +261,27 @@ func (r *FrameReader) reset() {
 	}
 }
 
+// compressedSource reads the compressed payload of a message across all of
+// its fragments, control frames in between are handled by NextFrame.
+type compressedSource struct {
+	r *FrameReader
+}
+
+func (s compressedSource) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.payload.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if !s.r.fragmented() {
+			return 0, io.EOF
+		}
+		if _, err = s.r.NextFrame(); err != nil {
+			return 0, err
+		}
+	}
+}
+
 // NextReader convenience
 func NextReader(r io.Reader, s ws.State) (ws.Header, io.Reader, error) {
 	rd := &FrameReader{Source: r, State: s}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// keepalive sends periodic pings and closes the transport when the peer stops
+// answering them or stays silent longer than the idle timeout.
+type keepalive struct {
+	t            *websocketTransport
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	idleTimeout  time.Duration
+
+	locker    sync.Mutex
+	stopped   bool
+	pingTimer *time.Timer
+	pongTimer *time.Timer
+	idleTimer *time.Timer
+
+	lastActive atomic.Int64 // unix nano of the last inbound bytes
+	pingSent   atomic.Int64 // unix nano of the outstanding ping, zero if none
+	rtt        atomic.Int64
+}
+
+func newKeepalive(t *websocketTransport) *keepalive {
+	ka := &keepalive{
+		t:            t,
+		pingInterval: t.options.PingInterval,
+		pongTimeout:  t.options.PongTimeout,
+		idleTimeout:  t.options.IdleTimeout,
+	}
+
+	// wait one interval for the pong by default
+	if ka.pongTimeout <= 0 {
+		ka.pongTimeout = ka.pingInterval
+	}
+
+	ka.touch()
+	return ka
+}
+
+func (ka *keepalive) start() {
+	ka.locker.Lock()
+	defer ka.locker.Unlock()
+
+	if ka.pingInterval > 0 {
+		ka.pingTimer = time.AfterFunc(ka.pingInterval, ka.ping)
+	}
+
+	if ka.idleTimeout > 0 {
+		ka.idleTimer = time.AfterFunc(ka.idleTimeout, ka.checkIdle)
+	}
+}
+
+func (ka *keepalive) stop() {
+	ka.locker.Lock()
+	defer ka.locker.Unlock()
+
+	ka.stopped = true
+	for _, timer := range []*time.Timer{ka.pingTimer, ka.pongTimer, ka.idleTimer} {
+		if nil != timer {
+			timer.Stop()
+		}
+	}
+}
+
+// touch records inbound activity.
+func (ka *keepalive) touch() {
+	ka.lastActive.Store(time.Now().UnixNano())
+}
+
+func (ka *keepalive) ping() {
+
+	sent := time.Now().UnixNano()
+
+	ka.locker.Lock()
+	if ka.stopped {
+		ka.locker.Unlock()
+		return
+	}
+	// keep the first outstanding ping, the peer has to answer it in time
+	if ka.pingSent.CompareAndSwap(0, sent) {
+		ka.pongTimer = time.AfterFunc(ka.pongTimeout, ka.pongTimedOut)
+	}
+	ka.pingTimer.Reset(ka.pingInterval)
+	ka.locker.Unlock()
+
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(sent))
+	if err := ka.t.writeFrame(ws.OpPing, true, false, payload[:]); nil == err {
+		_ = ka.t.Flush()
+	}
+}
+
+// pong handles pong payloads, a pong echoing the outstanding ping completes a
+// round trip.
+func (ka *keepalive) pong(payload []byte) {
+	if 8 != len(payload) {
+		return
+	}
+
+	sent := int64(binary.BigEndian.Uint64(payload))
+	if 0 == sent || !ka.pingSent.CompareAndSwap(sent, 0) {
+		return
+	}
+
+	ka.rtt.Store(time.Now().UnixNano() - sent)
+
+	ka.locker.Lock()
+	if nil != ka.pongTimer {
+		ka.pongTimer.Stop()
+	}
+	ka.locker.Unlock()
+}
+
+func (ka *keepalive) pongTimedOut() {
+	if 0 != ka.pingSent.Load() {
+		ka.closeDead("ping timeout")
+	}
+}
+
+func (ka *keepalive) checkIdle() {
+
+	ka.locker.Lock()
+	defer ka.locker.Unlock()
+
+	if ka.stopped {
+		return
+	}
+
+	idle := time.Duration(time.Now().UnixNano() - ka.lastActive.Load())
+	if idle < ka.idleTimeout {
+		ka.idleTimer.Reset(ka.idleTimeout - idle)
+		return
+	}
+
+	go ka.closeDead("idle timeout")
+}
+
+// closeDead closes the transport with 1001 Going Away.
+func (ka *keepalive) closeDead(reason string) {
+	ka.t.abort(ws.StatusGoingAway, reason)
+}
+
+// onPing queues the pong reply of a ping. The pong is written by another
+// goroutine, so the read loop never waits for a writer blocked on the peer,
+// which may itself be waiting for us to read. Only the latest ping is
+// answered if pings arrive faster than pongs are written.
+func (t *websocketTransport) onPing(payload []byte) {
+	t.pongLocker.Lock()
+	t.pongPayload = append(t.pongPayload[:0], payload...)
+	pending := t.pongPending
+	t.pongPending = true
+	t.pongLocker.Unlock()
+
+	if !pending {
+		go t.writePong()
+	}
+}
+
+func (t *websocketTransport) writePong() {
+	var payload [ws.MaxControlFramePayloadSize]byte
+
+	t.pongLocker.Lock()
+	n := copy(payload[:], t.pongPayload)
+	t.pongPending = false
+	t.pongLocker.Unlock()
+
+	// nothing may follow our close frame
+	if t.closeSent.Load() {
+		return
+	}
+
+	if err := t.writeFrame(ws.OpPong, true, false, payload[:n]); nil == err {
+		_ = t.Flush()
+	}
+}
+
+// RTT returns the round trip time measured by the last answered ping, zero if
+// keepalive is disabled or no pong has been received yet.
+func (t *websocketTransport) RTT() time.Duration {
+	if nil == t.keepalive {
+		return 0
+	}
+	return time.Duration(t.keepalive.rtt.Load())
+}
+
+// activityReader records inbound activity for the idle timeout.
+type activityReader struct {
+	io.Reader
+	ka *keepalive
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.ka.touch()
+	}
+	return n, err
+}
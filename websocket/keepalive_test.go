@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func drain(tp *websocketTransport) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			if _, err := tp.Read(buf); nil != err && io.EOF != err {
+				done <- err
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func TestKeepalive_MeasuresRTT(t *testing.T) {
+	opts := *DefaultOptions
+	opts.PingInterval = 10 * time.Millisecond
+	client, server := newTransportPair(t, opts.Apply(), ws.Handshake{})
+	defer client.Close()
+	defer server.Close()
+
+	drain(client)
+	drain(server)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for client.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected rtt to be measured")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestKeepalive_ClosesDeadPeer(t *testing.T) {
+	opts := *DefaultOptions
+	opts.PingInterval = 10 * time.Millisecond
+	opts.PongTimeout = 20 * time.Millisecond
+	client, _ := newTransportPair(t, opts.Apply(), ws.Handshake{})
+
+	// the server never reads, so pings are never answered
+	select {
+	case <-drain(client):
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected dead peer to be closed")
+	}
+}
+
+func TestKeepalive_ClosesIdlePeer(t *testing.T) {
+	opts := *DefaultOptions
+	opts.IdleTimeout = 20 * time.Millisecond
+	client, server := newTransportPair(t, opts.Apply(), ws.Handshake{})
+	defer client.Close()
+
+	select {
+	case <-drain(server):
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected idle peer to be closed")
+	}
+}
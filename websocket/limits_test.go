@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+func testMessageTooBig(t *testing.T, clientOpts, serverOpts *Options, hs ws.Handshake, payload []byte) {
+	client, server := newTransportPairWith(t, clientOpts, serverOpts, hs)
+
+	go func() {
+		w, err := client.NextWriter(ws.OpBinary)
+		if err != nil {
+			return
+		}
+		_, _ = w.Write(payload)
+		_ = w.Close()
+	}()
+
+	clientErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(readerFunc(client.Read))
+		clientErr <- err
+	}()
+
+	if _, err := io.ReadAll(readerFunc(server.Read)); err != ErrMessageTooBig {
+		t.Fatalf("expected ErrMessageTooBig, got: %v", err)
+	}
+
+	if err := <-clientErr; !IsCloseError(err, ws.StatusMessageTooBig) {
+		t.Fatalf("expected close with status 1009, got: %v", err)
+	}
+}
+
+func TestMaxMessageSize_Fragmented(t *testing.T) {
+	clientOpts := *DefaultOptions
+	clientOpts.FragmentSize = 1024
+
+	// every frame is within the frame limit, the message is not
+	serverOpts := *DefaultOptions
+	serverOpts.MaxFrameSize = 1024
+	serverOpts.MaxMessageSize = 4096
+
+	testMessageTooBig(t, clientOpts.Apply(), serverOpts.Apply(), ws.Handshake{}, bytes.Repeat([]byte("x"), 10000))
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+
+	clientOpts := *DefaultOptions
+	clientOpts.CompressEnabled = true
+
+	serverOpts := *DefaultOptions
+	serverOpts.CompressEnabled = true
+	serverOpts.MaxDecompressedSize = 1024
+
+	// a tiny compressed message inflating to 1MB
+	testMessageTooBig(t, clientOpts.Apply(), serverOpts.Apply(), hs, make([]byte, 1<<20))
+}
+
+func TestMaxMessageSize_BoundsInflation(t *testing.T) {
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+
+	clientOpts := *DefaultOptions
+	clientOpts.CompressEnabled = true
+
+	serverOpts := *DefaultOptions
+	serverOpts.CompressEnabled = true
+	serverOpts.MaxMessageSize = 4096
+
+	testMessageTooBig(t, clientOpts.Apply(), serverOpts.Apply(), hs, make([]byte, 64*1024))
+}
+
+func TestMaxMessageSize_WithinLimit(t *testing.T) {
+	opts := *DefaultOptions
+	opts.FragmentSize = 1024
+	opts.MaxMessageSize = 4096
+	client, server := newTransportPair(t, opts.Apply(), ws.Handshake{})
+
+	payload := bytes.Repeat([]byte("y"), 4096)
+	go func() {
+		w, _ := client.NextWriter(ws.OpText)
+		_, _ = w.Write(payload)
+		_ = w.Close()
+	}()
+
+	got, err := io.ReadAll(readerFunc(server.Read))
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected payload: %q", got)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// sharedRoute is a pattern registered on a shared ServeMux.
+type sharedRoute struct {
+	mux     *http.ServeMux
+	pattern string
+}
+
+// sharedRoutes holds the acceptors serving the routes of shared ServeMux. A
+// ServeMux can't unregister a pattern, so every pattern is registered once with
+// a handler dispatching to the acceptor serving it at the time, if any.
+var sharedRoutes = struct {
+	sync.RWMutex
+	acceptors map[sharedRoute]*wsAcceptor
+}{acceptors: make(map[sharedRoute]*wsAcceptor)}
+
+// handleShared serves pattern of mux with the acceptor, it fails if another
+// acceptor serves it already.
+func (w *wsAcceptor) handleShared(mux *http.ServeMux, pattern string) error {
+	route := sharedRoute{mux: mux, pattern: pattern}
+
+	sharedRoutes.Lock()
+	defer sharedRoutes.Unlock()
+
+	acceptor, registered := sharedRoutes.acceptors[route]
+	if nil != acceptor {
+		return fmt.Errorf("websocket: route %q is served by another listener", pattern)
+	}
+
+	if !registered {
+		mux.HandleFunc(pattern, route.serveHTTP)
+	}
+
+	sharedRoutes.acceptors[route] = w
+	w.sharedRoutes = append(w.sharedRoutes, route)
+	return nil
+}
+
+// unhandleShared stops serving the shared routes of the acceptor, their
+// patterns answer 404 until they are listened again.
+func (w *wsAcceptor) unhandleShared() {
+	sharedRoutes.Lock()
+	defer sharedRoutes.Unlock()
+
+	for _, route := range w.sharedRoutes {
+		if w == sharedRoutes.acceptors[route] {
+			// keep the key, the pattern stays registered on the mux
+			sharedRoutes.acceptors[route] = nil
+		}
+	}
+}
+
+func (r sharedRoute) serveHTTP(writer http.ResponseWriter, request *http.Request) {
+	sharedRoutes.RLock()
+	acceptor := sharedRoutes.acceptors[r]
+	sharedRoutes.RUnlock()
+
+	if nil == acceptor {
+		http.NotFound(writer, request)
+		return
+	}
+	acceptor.upgradeHTTP(writer, request)
+}
@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"io"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func TestWriteMessage_OpCodeReported(t *testing.T) {
+	opts := *DefaultOptions
+	opts.OpCode = ws.OpText | ws.OpBinary
+	client, server := newTransportPair(t, opts.Apply(), ws.Handshake{})
+
+	messages := []struct {
+		opCode  ws.OpCode
+		payload string
+	}{
+		{ws.OpText, `{"type":"subscribe"}`},
+		{ws.OpBinary, "\x00\x01\x02\x03"},
+		{ws.OpText, `{"type":"ack"}`},
+	}
+
+	go func() {
+		for _, m := range messages {
+			if _, err := client.WriteMessage(m.opCode, []byte(m.payload)); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, m := range messages {
+		got, err := io.ReadAll(readerFunc(server.Read))
+		if err != nil {
+			t.Fatalf("server read error: %v", err)
+		}
+		if server.MessageOpCode() != m.opCode {
+			t.Fatalf("unexpected opcode: got %v, want %v", server.MessageOpCode(), m.opCode)
+		}
+		if string(got) != m.payload {
+			t.Fatalf("unexpected payload: got %q, want %q", got, m.payload)
+		}
+	}
+}
+
+func TestWriteMessage_UnsupportedOpCode(t *testing.T) {
+	client, _ := newTransportPair(t, DefaultOptions, ws.Handshake{})
+	if _, err := client.WriteMessage(ws.OpClose, nil); err != ErrUnsupportedOpCode {
+		t.Fatalf("expected ErrUnsupportedOpCode, got: %v", err)
+	}
+}
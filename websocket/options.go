@@ -22,7 +22,10 @@ import (
 	"crypto/tls"
 	"io"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/go-netty/go-netty-transport/websocket/internal/wsutils"
 	"github.com/go-netty/go-netty/transport"
@@ -36,35 +39,77 @@ var DefaultOptions = (&Options{
 	OpCode:            ws.OpText,
 	Dialer:            ws.DefaultDialer,
 	Upgrader:          ws.DefaultHTTPUpgrader,
-	ServeMux:          http.DefaultServeMux,
 	Backlog:           128,
 	NoDelay:           true,
 	CompressEnabled:   false,
 	CompressLevel:     flate.BestSpeed,
 	CompressThreshold: 512,
+	FragmentSize:      32 * 1024,
+	CloseTimeout:      3 * time.Second,
 }).Apply()
 
 // Options to define the websocket
+//
+// HTTP2 serves and dials websockets on HTTP/2 streams (RFC 8441), Listen fails
+// unless the process runs with GODEBUG=http2xconnect=1 since the http2 server
+// refuses extended CONNECT otherwise. The streams of HTTP2 and HTTP3 are not
+// dialed through Proxy or Dialer.NetDial, Connect fails if either is set.
 type Options struct {
-	CertFile          string          `json:"certFile"`
-	KeyFile           string          `json:"keyFile"`
-	OpCode            ws.OpCode       `json:"opCode"`
-	Routers           []string        `json:"routers"`
-	CheckUTF8         bool            `json:"checkUTF8"`
-	MaxFrameSize      int64           `json:"maxFrameSize"`
-	ReadBufferSize    int             `json:"readBufferSize"`
-	WriteBufferSize   int             `json:"writeBufferSize"`
-	Backlog           int             `json:"backlog"`
-	NoDelay           bool            `json:"nodelay"`
-	CompressEnabled   bool            `json:"compressEnabled"`
-	CompressLevel     int             `json:"compressLevel"`
-	CompressThreshold int64           `json:"compressThreshold"`
-	TLS               *tls.Config     `json:"-"`
-	Dialer            ws.Dialer       `json:"-"`
-	Upgrader          ws.HTTPUpgrader `json:"-"`
-	ServeMux          *http.ServeMux  `json:"-"`
-	flateReaderPool   *sync.Pool
-	flateWriterPool   *sync.Pool
+	CertFile              string            `json:"certFile"`
+	KeyFile               string            `json:"keyFile"`
+	OpCode                ws.OpCode         `json:"opCode"`
+	Routers               []string          `json:"routers"`
+	CheckUTF8             bool              `json:"checkUTF8"`
+	MaxFrameSize          int64             `json:"maxFrameSize"`
+	MaxMessageSize        int64             `json:"maxMessageSize"`
+	MaxDecompressedSize   int64             `json:"maxDecompressedSize"`
+	ReadBufferSize        int               `json:"readBufferSize"`
+	WriteBufferSize       int               `json:"writeBufferSize"`
+	Backlog               int               `json:"backlog"`
+	NoDelay               bool              `json:"nodelay"`
+	CompressEnabled       bool              `json:"compressEnabled"`
+	CompressLevel         int               `json:"compressLevel"`
+	CompressThreshold     int64             `json:"compressThreshold"`
+	ServerContextTakeover bool              `json:"serverContextTakeover"`
+	ClientContextTakeover bool              `json:"clientContextTakeover"`
+	ServerMaxWindowBits   int               `json:"serverMaxWindowBits"`
+	ClientMaxWindowBits   int               `json:"clientMaxWindowBits"`
+	ReadHeaderTimeout     time.Duration     `json:"readHeaderTimeout"`
+	HTTPIdleTimeout       time.Duration     `json:"httpIdleTimeout"`
+	MaxHeaderBytes        int               `json:"maxHeaderBytes"`
+	HandshakeTimeout      time.Duration     `json:"handshakeTimeout"`
+	MaxConnections        int               `json:"maxConnections"`
+	RetryAfter            time.Duration     `json:"retryAfter"`
+	FragmentSize          int               `json:"fragmentSize"`
+	PingInterval          time.Duration     `json:"pingInterval"`
+	PongTimeout           time.Duration     `json:"pongTimeout"`
+	IdleTimeout           time.Duration     `json:"idleTimeout"`
+	CloseTimeout          time.Duration     `json:"closeTimeout"`
+	Protocols             []string          `json:"protocols"`
+	AllowedOrigins        []string          `json:"allowedOrigins"`
+	ProxyURL              string            `json:"proxyURL"`
+	HTTP2                 bool              `json:"http2"`
+	HTTP3                 bool              `json:"http3"`
+	TrustedProxies        []string          `json:"trustedProxies"`
+	LongPolling           bool              `json:"longPolling"`
+	PollTimeout           time.Duration     `json:"pollTimeout"`
+	WriteQueueMessages    int               `json:"writeQueueMessages"`
+	WriteQueueBytes       int               `json:"writeQueueBytes"`
+	WriteQueuePolicy      QueuePolicy       `json:"writeQueuePolicy"`
+	TLS                   *tls.Config       `json:"-"`
+	Dialer                ws.Dialer         `json:"-"`
+	Upgrader              ws.HTTPUpgrader   `json:"-"`
+	ServeMux              *http.ServeMux    `json:"-"`
+	SelectProtocol        ProtocolSelector  `json:"-"`
+	CheckUpgrade          UpgradeChecker    `json:"-"`
+	Proxy                 ProxyFunc         `json:"-"`
+	CompressFilter        CompressFilter    `json:"-"`
+	Registry              *Registry         `json:"-"`
+	Reconnect             *ReconnectOptions `json:"-"`
+	flateReaderPool       *sync.Pool
+	flateWriterPool       *sync.Pool
+	streamClient          *streamClient
+	trustedProxies        []netip.Prefix
 }
 
 func (o *Options) Apply() *Options {
@@ -87,21 +132,39 @@ func (o *Options) Apply() *Options {
 			})
 		}
 
-		if nil == o.Upgrader.Negotiate {
-			o.Upgrader.Negotiate = func(option httphead.Option) (httphead.Option, error) {
-				e := wsflate.Extension{
-					Parameters: wsflate.DefaultParameters,
-				}
-				return e.Negotiate(option)
-			}
+		// the server side negotiates per request, see prepareUpgrade
+		if nil == o.Dialer.Extensions {
+			o.Dialer.Extensions = []httphead.Option{o.deflateOffer()}
 		}
+	}
 
-		if nil == o.Dialer.Extensions {
-			o.Dialer.Extensions = []httphead.Option{wsflate.DefaultParameters.Option()}
+	if "" != o.ProxyURL && nil == o.Proxy {
+		if u, err := url.Parse(o.ProxyURL); nil != err {
+			panic(err)
+		} else {
+			o.Proxy = ProxyURL(u)
 		}
 	}
 
+	// the connections are shared by the channels dialed with the options
+	if (o.HTTP2 || o.HTTP3) && (nil == o.streamClient || o.streamClient.tlsConfig != o.TLS) {
+		o.streamClient = newStreamClient(o.TLS)
+	}
+
+	if len(o.Protocols) > 0 && nil == o.Dialer.Protocols {
+		o.Dialer.Protocols = o.Protocols
+	}
+
+	if prefixes, err := parseTrustedProxies(o.TrustedProxies); nil != err {
+		panic(err)
+	} else {
+		o.trustedProxies = prefixes
+	}
+
 	if "" != o.CertFile && "" != o.KeyFile {
+		if nil == o.TLS {
+			o.TLS = &tls.Config{}
+		}
 		if cer, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile); nil != err {
 			panic(err)
 		} else {
@@ -0,0 +1,1014 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+// The long-polling fallback serves clients whose proxies strip the Upgrade
+// header on the websocket routes, see Options.LongPolling:
+//
+//	POST ?transport=polling          opens a session, the response body is its id
+//	GET  ?transport=polling&sid=id   waits up to Options.PollTimeout for messages
+//	POST ?transport=polling&sid=id   sends messages
+//	DELETE ?transport=polling&sid=id closes the session
+//
+// The bodies carry messages as a 1 byte opcode and a 4 byte big-endian length
+// followed by the payload, a close message ends the session like a close frame.
+const (
+	pollingParam      = "transport"
+	pollingValue      = "polling"
+	pollingSessionID  = "sid"
+	pollingHeaderSize = 5
+)
+
+const (
+	defaultPollTimeout = 25 * time.Second
+	// maxPollingBacklog bounds the bytes a server session keeps for the polls,
+	// writes block until a poll takes them.
+	maxPollingBacklog = 1 << 20
+	// pollingInboundSize bounds the received messages waiting for Read, sends
+	// block until they are read.
+	pollingInboundSize = 64
+	maxSessionIDLength = 64
+)
+
+var errPollingSession = errors.New("websocket: polling session closed")
+
+// liveTransport is a server transport tracked by the acceptor and the registry
+// until it is closed.
+type liveTransport interface {
+	Transport
+	WriteClose(code int, reason string) error
+	onRelease(hook func())
+}
+
+var (
+	_ liveTransport = (*websocketTransport)(nil)
+	_ liveTransport = (*pollingTransport)(nil)
+)
+
+func isPolling(request *http.Request) bool {
+	return pollingValue == request.URL.Query().Get(pollingParam)
+}
+
+func (o *Options) pollTimeout() time.Duration {
+	if o.PollTimeout > 0 {
+		return o.PollTimeout
+	}
+	return defaultPollTimeout
+}
+
+func (o *Options) closeTimeout() time.Duration {
+	if o.CloseTimeout > 0 {
+		return o.CloseTimeout
+	}
+	return defaultCloseTimeout
+}
+
+type pollingMessage struct {
+	opCode  ws.OpCode
+	payload []byte
+}
+
+func encodePolling(buffer *bytes.Buffer, messages []pollingMessage) {
+	var header [pollingHeaderSize]byte
+	for _, message := range messages {
+		header[0] = byte(message.opCode)
+		binary.BigEndian.PutUint32(header[1:], uint32(len(message.payload)))
+		buffer.Write(header[:])
+		buffer.Write(message.payload)
+	}
+}
+
+// decodePolling calls fn with the messages of body, a message larger than
+// limit fails with ErrMessageTooBig.
+func decodePolling(body io.Reader, limit int64, fn func(message pollingMessage) error) error {
+	var header [pollingHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(body, header[:]); nil != err {
+			if io.EOF == err {
+				return nil
+			}
+			return err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[1:]))
+		if limit > 0 && length > limit {
+			return ErrMessageTooBig
+		}
+
+		payload, err := io.ReadAll(io.LimitReader(body, length))
+		if nil != err {
+			return err
+		}
+		if int64(len(payload)) != length {
+			return io.ErrUnexpectedEOF
+		}
+
+		if err = fn(pollingMessage{opCode: ws.OpCode(header[0]), payload: payload}); nil != err {
+			return err
+		}
+	}
+}
+
+// pollingTransport is a websocket session carried by HTTP requests. The server
+// side queues the outbound messages for the polls of the client, the client
+// side posts them on Flush.
+type pollingTransport struct {
+	options    *Options
+	client     *pollingClient // nil on the server side
+	id         string
+	opCode     ws.OpCode
+	msgOpCode  ws.OpCode
+	request    *http.Request
+	response   *http.Response // open response, client side only
+	attachment interface{}
+	local      net.Addr
+	remote     net.Addr
+	tlsState   *tls.ConnectionState
+	// received messages, message is the one being read
+	inbound chan pollingMessage
+	message *bytes.Reader
+	locker  sync.Mutex
+	// messages waiting for a poll or a Flush
+	outbound []pollingMessage
+	queued   int
+	pending  chan struct{}
+	space    chan struct{}
+	// deadlines, wake is closed when they change
+	readDeadline  time.Time
+	writeDeadline time.Time
+	wake          chan struct{}
+	// close handshake state, closeErr is returned by Read once closed
+	closeSent     atomic.Bool
+	closeReceived chan struct{}
+	receivedOnce  sync.Once
+	closeErr      error
+	closed        chan struct{}
+	closeOnce     sync.Once
+	// expires the server session when the client stops polling
+	expiry       *time.Timer
+	releaseHooks []func()
+	released     bool
+}
+
+func newPollingTransport(options *Options, request *http.Request) *pollingTransport {
+	t := &pollingTransport{
+		options:       options,
+		request:       request,
+		inbound:       make(chan pollingMessage, pollingInboundSize),
+		pending:       make(chan struct{}, 1),
+		space:         make(chan struct{}, 1),
+		wake:          make(chan struct{}),
+		closeReceived: make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+
+	// setup opcode
+	if t.opCode = ws.OpText; 0 == (options.OpCode & ws.OpText) {
+		t.opCode = ws.OpBinary
+	}
+	return t
+}
+
+// newPollingSession opens the server side of a session.
+func newPollingSession(options *Options, request *http.Request, attachment interface{}) (*pollingTransport, error) {
+
+	var id [16]byte
+	if _, err := rand.Read(id[:]); nil != err {
+		return nil, err
+	}
+
+	t := newPollingTransport(options, request)
+	t.id = hex.EncodeToString(id[:])
+	t.attachment = attachment
+	t.tlsState = request.TLS
+
+	network := "tcp"
+	if local, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		t.local, network = local, local.Network()
+	} else {
+		t.local = streamAddr{network: network}
+	}
+	t.remote = streamAddr{network: network, address: request.RemoteAddr}
+
+	t.expiry = time.AfterFunc(2*options.pollTimeout(), func() { t.shutdown(io.ErrUnexpectedEOF) })
+	return t, nil
+}
+
+// serve answers a request of the session.
+func (t *pollingTransport) serve(writer http.ResponseWriter, request *http.Request) {
+
+	// the client is alive as long as it polls
+	t.expiry.Reset(2 * t.options.pollTimeout())
+
+	switch request.Method {
+	case http.MethodGet:
+		t.poll(writer, request)
+	case http.MethodPost:
+		t.receive(writer, request)
+	case http.MethodDelete:
+		_ = t.Close()
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// poll answers with the queued messages, or with 204 No Content if none was
+// queued until the poll timeout.
+func (t *pollingTransport) poll(writer http.ResponseWriter, request *http.Request) {
+
+	timer := time.NewTimer(t.options.pollTimeout())
+	defer timer.Stop()
+
+	for {
+		// the messages queued before Close, such as the close reply, are
+		// still delivered
+		if messages := t.take(); len(messages) > 0 {
+			var buffer bytes.Buffer
+			encodePolling(&buffer, messages)
+			writer.Header().Set("Content-Type", "application/octet-stream")
+			writer.Header().Set("Cache-Control", "no-store")
+			_, _ = writer.Write(buffer.Bytes())
+			return
+		}
+
+		select {
+		case <-t.pending:
+		case <-timer.C:
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		case <-t.closed:
+			http.Error(writer, errPollingSession.Error(), http.StatusGone)
+			return
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+// receive queues the messages sent by the client for Read.
+func (t *pollingTransport) receive(writer http.ResponseWriter, request *http.Request) {
+
+	err := decodePolling(request.Body, t.options.MaxMessageSize, func(message pollingMessage) error {
+		return t.push(request.Context(), message)
+	})
+
+	switch {
+	case nil == err:
+		writer.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrMessageTooBig):
+		http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+		t.abort(ws.StatusMessageTooBig, "message too big")
+	case errors.Is(err, net.ErrClosed):
+		http.Error(writer, errPollingSession.Error(), http.StatusGone)
+	default:
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// push hands a received message to Read, it blocks while Read is behind.
+func (t *pollingTransport) push(ctx context.Context, message pollingMessage) error {
+
+	if ws.OpClose == message.opCode {
+		t.onClose(message.payload)
+		return nil
+	}
+
+	if !message.opCode.IsData() || 0 == (message.opCode&t.options.OpCode) {
+		// close the session because it has received a type of data it cannot accept
+		_ = t.WriteClose(int(ws.StatusUnsupportedData), "unsupported data type")
+		return nil
+	}
+
+	select {
+	case t.inbound <- message:
+		return nil
+	case <-t.closed:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// onClose is called when the peer's close message arrives, it is echoed unless
+// we started the close handshake.
+func (t *pollingTransport) onClose(payload []byte) {
+	closeErr := CloseError{Code: ws.StatusNoStatusRcvd}
+	if len(payload) >= 2 {
+		closeErr.Code = ws.StatusCode(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	}
+
+	t.locker.Lock()
+	if nil == t.closeErr {
+		t.closeErr = closeErr
+	}
+	t.locker.Unlock()
+	t.receivedOnce.Do(func() { close(t.closeReceived) })
+
+	if t.closeSent.CompareAndSwap(false, true) {
+		_ = t.enqueue(pollingMessage{opCode: ws.OpClose, payload: payload}, false)
+		if nil != t.client {
+			_ = t.Flush()
+		}
+	}
+}
+
+// take removes the outbound messages.
+func (t *pollingTransport) take() []pollingMessage {
+	t.locker.Lock()
+	messages := t.outbound
+	t.outbound, t.queued = nil, 0
+	t.locker.Unlock()
+
+	if len(messages) > 0 {
+		signal(t.space)
+	}
+	return messages
+}
+
+func (t *pollingTransport) hasOutbound() bool {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return len(t.outbound) > 0
+}
+
+// enqueue adds an outbound message, a bounded message waits until the backlog
+// of a server session has room for it.
+func (t *pollingTransport) enqueue(message pollingMessage, bounded bool) error {
+	for {
+		t.locker.Lock()
+		select {
+		case <-t.closed:
+			t.locker.Unlock()
+			return net.ErrClosed
+		default:
+		}
+
+		if !bounded || nil != t.client || 0 == t.queued || t.queued+len(message.payload) <= maxPollingBacklog {
+			t.outbound = append(t.outbound, message)
+			t.queued += len(message.payload)
+			t.locker.Unlock()
+			signal(t.pending)
+			return nil
+		}
+
+		deadline, wake := t.writeDeadline, t.wake
+		t.locker.Unlock()
+
+		expired, stop := after(deadline)
+		select {
+		case <-t.space:
+		case <-wake:
+		case <-t.closed:
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		}
+		stop()
+	}
+}
+
+// signal wakes up a waiter of ch without blocking.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// after returns a channel receiving at the deadline, nil if there is none.
+func after(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	return timer.C, timer.Stop
+}
+
+// Read reads the next message payload into p, the error is io.EOF once all of
+// the message bytes were read. It is a CloseError if the peer closed the session.
+func (t *pollingTransport) Read(p []byte) (int, error) {
+
+	if nil == t.message {
+		message, err := t.next()
+		if nil != err {
+			return 0, err
+		}
+		t.msgOpCode, t.message = message.opCode, bytes.NewReader(message.payload)
+	}
+
+	n, _ := t.message.Read(p)
+	if 0 == t.message.Len() {
+		// all of message bytes were read
+		t.message = nil
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (t *pollingTransport) next() (pollingMessage, error) {
+	for {
+		// the messages received before the close are read first
+		select {
+		case message := <-t.inbound:
+			return message, nil
+		default:
+		}
+
+		t.locker.Lock()
+		deadline, wake := t.readDeadline, t.wake
+		t.locker.Unlock()
+
+		expired, stop := after(deadline)
+		select {
+		case message := <-t.inbound:
+			stop()
+			return message, nil
+		case <-t.closeReceived:
+		case <-t.closed:
+		case <-wake:
+			stop()
+			continue
+		case <-expired:
+			return pollingMessage{}, os.ErrDeadlineExceeded
+		}
+		stop()
+
+		select {
+		case message := <-t.inbound:
+			return message, nil
+		default:
+		}
+
+		t.locker.Lock()
+		err := t.closeErr
+		t.locker.Unlock()
+		return pollingMessage{}, err
+	}
+}
+
+// MessageOpCode returns the opcode of the inbound message being read.
+func (t *pollingTransport) MessageOpCode() ws.OpCode {
+	return t.msgOpCode
+}
+
+// Write queues p as a single message with the opcode selected by Options.OpCode.
+func (t *pollingTransport) Write(p []byte) (int, error) {
+	return t.writeMessage(t.opCode, p)
+}
+
+// WriteMessage queues p as a single message with the given opcode, which must be
+// OpText or OpBinary.
+func (t *pollingTransport) WriteMessage(opCode ws.OpCode, p []byte) (int, error) {
+	if ws.OpText != opCode && ws.OpBinary != opCode {
+		return 0, ErrUnsupportedOpCode
+	}
+	return t.writeMessage(opCode, p)
+}
+
+func (t *pollingTransport) writeMessage(opCode ws.OpCode, p []byte) (int, error) {
+	if err := t.enqueue(pollingMessage{opCode: opCode, payload: append([]byte(nil), p...)}, true); nil != err {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writev queues the buffers as a single message with the opcode selected by
+// Options.OpCode.
+func (t *pollingTransport) Writev(buffs transport.Buffers) (int64, error) {
+	payload := bytes.Join(buffs, nil)
+	if err := t.enqueue(pollingMessage{opCode: t.opCode, payload: payload}, true); nil != err {
+		return 0, err
+	}
+	return int64(len(payload)), nil
+}
+
+// NextWriter returns a writer queueing the written data as one message when it
+// is closed, messages are never fragmented by the polling transport.
+func (t *pollingTransport) NextWriter(opCode ws.OpCode) (io.WriteCloser, error) {
+	if ws.OpText != opCode && ws.OpBinary != opCode {
+		return nil, ErrUnsupportedOpCode
+	}
+	return &pollingWriter{t: t, opCode: opCode}, nil
+}
+
+// WritePreparedMessage queues the message, the prepared data is shared.
+func (t *pollingTransport) WritePreparedMessage(pm *PreparedMessage) error {
+	return t.enqueue(pollingMessage{opCode: pm.opCode, payload: pm.data}, true)
+}
+
+// Flush posts the queued messages on the client side, the polls take them on
+// the server side.
+func (t *pollingTransport) Flush() error {
+	if nil == t.client {
+		select {
+		case <-t.closed:
+			return net.ErrClosed
+		default:
+			return nil
+		}
+	}
+	return t.client.send(t)
+}
+
+// WriteClose queues a close message with the given code and reason, it does
+// nothing if a close message has already been sent.
+func (t *pollingTransport) WriteClose(code int, reason string) error {
+	if !t.closeSent.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	err := t.enqueue(pollingMessage{opCode: ws.OpClose, payload: ws.NewCloseFrameBody(ws.StatusCode(code), reason)}, false)
+	if nil == err && nil != t.client {
+		err = t.Flush()
+	}
+	return err
+}
+
+// GracefulClose sends a close message, waits up to Options.CloseTimeout for the
+// peer's close message and then closes the session.
+func (t *pollingTransport) GracefulClose(code int, reason string) error {
+
+	err := t.WriteClose(code, reason)
+	if nil == err {
+		timer := time.NewTimer(t.options.closeTimeout())
+		select {
+		case <-t.closeReceived:
+		case <-t.closed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	if cerr := t.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+func (t *pollingTransport) abort(code ws.StatusCode, reason string) {
+	_ = t.WriteClose(int(code), reason)
+	_ = t.Close()
+}
+
+// onRelease adds a hook called once when the session is closed, it is called
+// right away if the session is closed already.
+func (t *pollingTransport) onRelease(hook func()) {
+	t.locker.Lock()
+	if !t.released {
+		t.releaseHooks = append(t.releaseHooks, hook)
+		t.locker.Unlock()
+		return
+	}
+	t.locker.Unlock()
+	hook()
+}
+
+// Close closes the session, the pending reads and writes fail.
+func (t *pollingTransport) Close() error {
+	t.shutdown(net.ErrClosed)
+	return nil
+}
+
+// shutdown closes the session, cause is returned by Read unless the peer
+// closed it.
+func (t *pollingTransport) shutdown(cause error) {
+	t.closeOnce.Do(func() {
+		t.locker.Lock()
+		if nil == t.closeErr {
+			t.closeErr = cause
+		}
+		close(t.closed)
+		hooks := t.releaseHooks
+		t.releaseHooks, t.released = nil, true
+		t.locker.Unlock()
+
+		if nil != t.expiry {
+			t.expiry.Stop()
+		}
+		if nil != t.client {
+			t.client.close(t)
+		}
+		for _, hook := range hooks {
+			hook()
+		}
+	})
+}
+
+func (t *pollingTransport) SetDeadline(deadline time.Time) error {
+	t.locker.Lock()
+	t.readDeadline, t.writeDeadline = deadline, deadline
+	t.wakeUp()
+	t.locker.Unlock()
+	return nil
+}
+
+func (t *pollingTransport) SetReadDeadline(deadline time.Time) error {
+	t.locker.Lock()
+	t.readDeadline = deadline
+	t.wakeUp()
+	t.locker.Unlock()
+	return nil
+}
+
+func (t *pollingTransport) SetWriteDeadline(deadline time.Time) error {
+	t.locker.Lock()
+	t.writeDeadline = deadline
+	t.wakeUp()
+	t.locker.Unlock()
+	return nil
+}
+
+// wakeUp makes the waiting reads and writes see the new deadlines, the locker
+// must be held.
+func (t *pollingTransport) wakeUp() {
+	close(t.wake)
+	t.wake = make(chan struct{})
+}
+
+func (t *pollingTransport) LocalAddr() net.Addr {
+	return t.local
+}
+
+func (t *pollingTransport) RemoteAddr() net.Addr {
+	return t.remote
+}
+
+// RawTransport returns the handshake request, a session has no connection of
+// its own.
+func (t *pollingTransport) RawTransport() interface{} {
+	return t.request
+}
+
+func (t *pollingTransport) Route() string {
+	return t.request.URL.Path
+}
+
+func (t *pollingTransport) Header() http.Header {
+	if nil != t.response {
+		// client side
+		return t.response.Header
+	}
+	return t.request.Header
+}
+
+func (t *pollingTransport) Request() *http.Request {
+	return t.request
+}
+
+// Subprotocol returns an empty string, subprotocols are not negotiated by the
+// polling transport.
+func (t *pollingTransport) Subprotocol() string {
+	return ""
+}
+
+func (t *pollingTransport) Attachment() interface{} {
+	return t.attachment
+}
+
+func (t *pollingTransport) Response() *http.Response {
+	return t.response
+}
+
+func (t *pollingTransport) TLS() *tls.ConnectionState {
+	return t.tlsState
+}
+
+// RTT returns zero, the polling transport sends no pings.
+func (t *pollingTransport) RTT() time.Duration {
+	return 0
+}
+
+// pollingWriter queues one message when it is closed.
+type pollingWriter struct {
+	t      *pollingTransport
+	opCode ws.OpCode
+	buffer bytes.Buffer
+	closed bool
+}
+
+func (w *pollingWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	return w.buffer.Write(p)
+}
+
+func (w *pollingWriter) Close() error {
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
+	return w.t.enqueue(pollingMessage{opCode: w.opCode, payload: w.buffer.Bytes()}, true)
+}
+
+// openPolling opens a session for the request and answers with its id.
+func (w *wsAcceptor) openPolling(upgrader ws.HTTPUpgrader, writer http.ResponseWriter, request *http.Request, attachment interface{}) (*pollingTransport, error) {
+
+	session, err := newPollingSession(w.wsOptions, request, attachment)
+	if nil != err {
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	w.locker.Lock()
+	w.sessions[session.id] = session
+	w.locker.Unlock()
+
+	session.onRelease(func() {
+		forget := func() {
+			w.locker.Lock()
+			if w.sessions[session.id] == session {
+				delete(w.sessions, session.id)
+			}
+			w.locker.Unlock()
+		}
+		if session.hasOutbound() {
+			// the last messages are left for a poll
+			time.AfterFunc(w.wsOptions.closeTimeout(), forget)
+			return
+		}
+		forget()
+	})
+
+	for key, values := range upgrader.Header {
+		writer.Header()[key] = values
+	}
+	writer.Header().Set("Content-Type", "text/plain")
+	writer.Header().Set("Cache-Control", "no-store")
+	_, _ = io.WriteString(writer, session.id)
+	return session, nil
+}
+
+// servePolling answers the requests of an open session.
+func (w *wsAcceptor) servePolling(writer http.ResponseWriter, request *http.Request, id string) {
+	w.locker.Lock()
+	session := w.sessions[id]
+	w.locker.Unlock()
+
+	if nil == session {
+		http.Error(writer, errPollingSession.Error(), http.StatusNotFound)
+		return
+	}
+	session.serve(writer, request)
+}
+
+// pollingClient carries the requests of a client session.
+type pollingClient struct {
+	http   *http.Client
+	url    string
+	header http.Header
+	// canceled when the session is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// serializes the posts, so the messages arrive in order
+	sendLocker sync.Mutex
+}
+
+// connectPolling opens a session on the websocket route u.
+func connectPolling(ctx context.Context, options *Options, dialer ws.Dialer, u *url.URL, header http.Header) (*pollingTransport, error) {
+
+	target := *u
+	if target.Scheme = "http"; "wss" == u.Scheme {
+		target.Scheme = "https"
+	}
+	query := target.Query()
+	query.Set(pollingParam, pollingValue)
+	target.RawQuery = query.Encode()
+
+	roundTripper := &http.Transport{
+		TLSClientConfig:   dialer.TLSConfig,
+		DialContext:       dialer.NetDial,
+		ForceAttemptHTTP2: true,
+	}
+	if nil != options.Proxy {
+		// forwarded by the proxy rather than tunneled through it
+		roundTripper.DialContext = nil
+		roundTripper.Proxy = func(request *http.Request) (*url.URL, error) {
+			return options.Proxy(request.URL)
+		}
+	}
+
+	requestHeader := header.Clone()
+	if nil == requestHeader {
+		requestHeader = make(http.Header)
+	}
+
+	// the session outlives the dial context
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	client := &pollingClient{
+		http:   &http.Client{Transport: roundTripper},
+		header: requestHeader,
+		ctx:    sessionCtx,
+		cancel: cancel,
+	}
+
+	openCtx := ctx
+	if dialer.Timeout > 0 {
+		var cancelOpen context.CancelFunc
+		openCtx, cancelOpen = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancelOpen()
+	}
+
+	var local, remote net.Addr
+	var tlsState *tls.ConnectionState
+	openCtx = httptrace.WithClientTrace(openCtx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			local, remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+			tlsState = connectionState(info.Conn)
+		},
+	})
+
+	request, err := http.NewRequestWithContext(openCtx, http.MethodPost, target.String(), http.NoBody)
+	if nil != err {
+		cancel()
+		return nil, err
+	}
+	request.Header = requestHeader
+
+	response, err := client.http.Do(request)
+	if nil != err {
+		cancel()
+		return nil, err
+	}
+	id, err := io.ReadAll(io.LimitReader(response.Body, maxSessionIDLength+1))
+	_ = response.Body.Close()
+	if nil == err && http.StatusOK != response.StatusCode {
+		err = ws.StatusError(response.StatusCode)
+	}
+	if nil == err && (0 == len(id) || len(id) > maxSessionIDLength) {
+		err = errPollingSession
+	}
+	if nil != err {
+		cancel()
+		roundTripper.CloseIdleConnections()
+		return nil, err
+	}
+
+	query.Set(pollingSessionID, string(id))
+	target.RawQuery = query.Encode()
+	client.url = target.String()
+
+	network := "tcp"
+	if nil == local {
+		local, remote = streamAddr{network: network}, streamAddr{network: network, address: target.Host}
+	}
+	if nil == tlsState {
+		tlsState = response.TLS
+	}
+	request.RemoteAddr = remote.String()
+	response.Request = request
+
+	t := newPollingTransport(options, request)
+	t.client = client
+	t.id = string(id)
+	t.response = response
+	t.local, t.remote = local, remote
+	t.tlsState = tlsState
+
+	go client.poll(t)
+	return t, nil
+}
+
+func (c *pollingClient) newRequest(method string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(c.ctx, method, c.url, body)
+	if nil != err {
+		return nil, err
+	}
+	request.Header = c.header.Clone()
+	return request, nil
+}
+
+// poll receives the messages of the session until it is closed.
+func (c *pollingClient) poll(t *pollingTransport) {
+	for {
+		err := c.receive(t)
+		if nil != err {
+			t.shutdown(io.ErrUnexpectedEOF)
+			return
+		}
+
+		select {
+		case <-t.closeReceived:
+			// nothing follows the close message
+			return
+		default:
+		}
+	}
+}
+
+func (c *pollingClient) receive(t *pollingTransport) error {
+	request, err := c.newRequest(http.MethodGet, nil)
+	if nil != err {
+		return err
+	}
+
+	response, err := c.http.Do(request)
+	if nil != err {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return decodePolling(response.Body, t.options.MaxMessageSize, func(message pollingMessage) error {
+			return t.push(c.ctx, message)
+		})
+	case http.StatusNoContent:
+		return nil
+	}
+	return ws.StatusError(response.StatusCode)
+}
+
+// send posts the queued messages.
+func (c *pollingClient) send(t *pollingTransport) error {
+	c.sendLocker.Lock()
+	defer c.sendLocker.Unlock()
+
+	messages := t.take()
+	if 0 == len(messages) {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	encodePolling(&buffer, messages)
+
+	request, err := c.newRequest(http.MethodPost, &buffer)
+	if nil != err {
+		return err
+	}
+
+	response, err := c.http.Do(request)
+	if nil != err {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	_ = response.Body.Close()
+
+	if http.StatusNoContent != response.StatusCode && http.StatusOK != response.StatusCode {
+		return ws.StatusError(response.StatusCode)
+	}
+	return nil
+}
+
+// close ends the session on the server unless it ended there, the requests in
+// flight are canceled.
+func (c *pollingClient) close(t *pollingTransport) {
+	c.cancel()
+
+	select {
+	case <-t.closeReceived:
+		c.http.CloseIdleConnections()
+		return
+	default:
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), closeWriteTimeout)
+		defer cancel()
+
+		if request, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.url, nil); nil == err {
+			request.Header = c.header.Clone()
+			if response, err := c.http.Do(request); nil == err {
+				_ = response.Body.Close()
+			}
+		}
+		c.http.CloseIdleConnections()
+	}()
+}
@@ -0,0 +1,223 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+// listenBehindStrippingProxy serves the websocket routes through a handler
+// dropping the upgrade headers, like the proxies the fallback is made for.
+func listenBehindStrippingProxy(t *testing.T, opts *Options) (*wsAcceptor, string) {
+	opts.ServeMux = http.NewServeMux()
+	acceptor := listenWebsocket(t, opts)
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request.Header.Del("Upgrade")
+		request.Header.Del("Connection")
+		opts.ServeMux.ServeHTTP(writer, request)
+	}))
+	t.Cleanup(server.Close)
+	return acceptor, strings.Replace(server.URL, "http://", "ws://", 1)
+}
+
+func connectTransport(t *testing.T, url string, opts *Options, extra ...transport.Option) (Transport, error) {
+	options, err := transport.ParseOptions(context.Background(), url, append([]transport.Option{WithOptions(opts)}, extra...)...)
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	tt, err := New().Connect(options)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { _ = tt.Close() })
+	return tt.(Transport), nil
+}
+
+func TestLongPolling_Fallback(t *testing.T) {
+	registry := NewRegistry()
+	opts := *DefaultOptions
+	opts.LongPolling = true
+	opts.PollTimeout = 200 * time.Millisecond
+	opts.Registry = registry
+	acceptor, url := listenBehindStrippingProxy(t, &opts)
+
+	clientOpts := *DefaultOptions
+	clientOpts.LongPolling = true
+	client, err := connectTransport(t, url+"/ws?room=1", &clientOpts, WithHeader(http.Header{"X-Token": {"secret"}}))
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	accepted, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	server := accepted.(Transport)
+	defer server.Close()
+
+	if _, ok := server.(*pollingTransport); !ok {
+		t.Fatalf("expected a polling session, got %T", server)
+	}
+	if server.Route() != "/ws" || server.Header().Get("X-Token") != "secret" || server.Request().URL.Query().Get("room") != "1" {
+		t.Fatalf("unexpected session request: %s %v", server.Route(), server.Header())
+	}
+	if client.Route() != "/ws" || client.Response().StatusCode != http.StatusOK {
+		t.Fatalf("unexpected client session: %s %v", client.Route(), client.Response().Status)
+	}
+	if registry.CountRoute("/ws") != 1 {
+		t.Fatalf("expected the session to be registered")
+	}
+
+	roundTrip(t, client, server, "from client")
+	roundTrip(t, server, client, "from server")
+
+	// the polls time out while nothing is sent
+	time.Sleep(3 * opts.PollTimeout)
+	roundTrip(t, server, client, "after idle polls")
+
+	pm, _ := NewPreparedMessage(ws.OpText, []byte("broadcast"))
+	if err = registry.BroadcastRoute("/ws", pm); err != nil {
+		t.Fatalf("broadcast error: %v", err)
+	}
+	if got, _ := io.ReadAll(readerFunc(client.Read)); string(got) != "broadcast" {
+		t.Fatalf("unexpected broadcast: %q", got)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(readerFunc(server.Read))
+		serverErr <- err
+	}()
+
+	if err = client.GracefulClose(int(ws.StatusNormalClosure), "bye"); err != nil {
+		t.Fatalf("graceful close error: %v", err)
+	}
+	if err = <-serverErr; !IsCloseError(err, ws.StatusNormalClosure) {
+		t.Fatalf("expected the close message, got %v", err)
+	}
+	_ = server.Close()
+	if registry.Count() != 0 {
+		t.Fatalf("expected the closed session to be removed")
+	}
+}
+
+func TestLongPolling_ServerClose(t *testing.T) {
+	opts := *DefaultOptions
+	opts.LongPolling = true
+	acceptor, url := listenBehindStrippingProxy(t, &opts)
+
+	client, err := connectTransport(t, url+"/ws", &opts)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	// queued before the close, delivered by the same poll
+	if _, err = server.Write([]byte("last words")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- server.(Transport).GracefulClose(int(ws.StatusGoingAway), "restart") }()
+
+	if got, _ := io.ReadAll(readerFunc(client.Read)); string(got) != "last words" {
+		t.Fatalf("unexpected message: %q", got)
+	}
+	if _, err = client.Read(make([]byte, 1)); !IsCloseError(err, ws.StatusGoingAway) {
+		t.Fatalf("expected the close message, got %v", err)
+	}
+	if err = <-closed; err != nil {
+		t.Fatalf("graceful close error: %v", err)
+	}
+	if _, err = server.Write([]byte("late")); err == nil {
+		t.Fatalf("expected write on a closed session to fail")
+	}
+}
+
+func TestLongPolling_Disabled(t *testing.T) {
+	opts := *DefaultOptions
+	_, url := listenBehindStrippingProxy(t, &opts)
+
+	clientOpts := *DefaultOptions
+	clientOpts.LongPolling = true
+	if _, err := connectTransport(t, url+"/ws", &clientOpts); err == nil {
+		t.Fatalf("expected the fallback to be refused")
+	}
+
+	// the fallback is not served without Options.LongPolling
+	response, err := http.Post(strings.Replace(url, "ws://", "http://", 1)+"/ws?transport=polling", "", nil)
+	if err != nil {
+		t.Fatalf("post error: %v", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		t.Fatalf("unexpected session")
+	}
+}
+
+func TestLongPolling_Expiry(t *testing.T) {
+	opts := *DefaultOptions
+	opts.LongPolling = true
+	opts.PollTimeout = 50 * time.Millisecond
+	acceptor, url := listenBehindStrippingProxy(t, &opts)
+
+	base := strings.Replace(url, "ws://", "http://", 1) + "/ws?transport=polling"
+	response, err := http.Post(base, "", nil)
+	if err != nil {
+		t.Fatalf("open error: %v", err)
+	}
+	_ = response.Body.Close()
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	// nobody polls the session
+	if _, err = server.Read(make([]byte, 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected the session to expire, got %v", err)
+	}
+	if acceptor.connections.Load() != 0 {
+		t.Fatalf("expected the connection slot to be released")
+	}
+
+	response, err = http.Get(base + "&sid=" + server.(*pollingTransport).id)
+	if err != nil {
+		t.Fatalf("poll error: %v", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected poll status: %d", response.StatusCode)
+	}
+}
+
+func TestDecodePolling(t *testing.T) {
+	var buffer bytes.Buffer
+	encodePolling(&buffer, []pollingMessage{{ws.OpText, []byte("one")}, {ws.OpBinary, nil}, {ws.OpText, []byte("three")}})
+
+	var got []pollingMessage
+	err := decodePolling(bytes.NewReader(buffer.Bytes()), 0, func(message pollingMessage) error {
+		got = append(got, message)
+		return nil
+	})
+	if err != nil || len(got) != 3 || string(got[2].payload) != "three" || got[1].opCode != ws.OpBinary {
+		t.Fatalf("unexpected messages: %v, %v", got, err)
+	}
+
+	if err = decodePolling(bytes.NewReader(buffer.Bytes()), 4, func(pollingMessage) error { return nil }); !errors.Is(err, ErrMessageTooBig) {
+		t.Fatalf("expected ErrMessageTooBig, got %v", err)
+	}
+	if err = decodePolling(bytes.NewReader(buffer.Bytes()[:buffer.Len()-1]), 0, func(pollingMessage) error { return nil }); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected a truncated body, got %v", err)
+	}
+}
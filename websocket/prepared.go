@@ -0,0 +1,154 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/go-netty/go-netty-transport/websocket/internal/wsutils"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	kpflate "github.com/klauspost/compress/flate"
+)
+
+// PreparedMessage is a message encoded once and written to many connections,
+// the encoded frame is cached per compression variant on first use.
+//
+// Compressed variants are deflated without context. Connections compressing
+// with context takeover write them too and then reset their compressor, so
+// their next message doesn't refer to bytes they never compressed.
+type PreparedMessage struct {
+	opCode ws.OpCode
+	data   []byte
+	locker sync.Mutex
+	frames map[preparedKey]*preparedFrame
+}
+
+// preparedKey identifies an encoding of the message.
+type preparedKey struct {
+	compressed bool
+	level      int
+	windowBits int
+}
+
+type preparedFrame struct {
+	once    sync.Once
+	payload []byte // compressed or raw payload
+	frame   []byte // header and payload, unmasked
+	err     error
+}
+
+// NewPreparedMessage returns a prepared message of opCode (OpText or OpBinary),
+// data must not be modified after the call.
+func NewPreparedMessage(opCode ws.OpCode, data []byte) (*PreparedMessage, error) {
+	if ws.OpText != opCode && ws.OpBinary != opCode {
+		return nil, ErrUnsupportedOpCode
+	}
+	return &PreparedMessage{opCode: opCode, data: data, frames: make(map[preparedKey]*preparedFrame)}, nil
+}
+
+func (pm *PreparedMessage) frame(key preparedKey) (*preparedFrame, error) {
+
+	pm.locker.Lock()
+	pf, ok := pm.frames[key]
+	if !ok {
+		pf = &preparedFrame{}
+		pm.frames[key] = pf
+	}
+	pm.locker.Unlock()
+
+	pf.once.Do(func() {
+		pf.payload = pm.data
+		if key.compressed {
+			if pf.payload, pf.err = compressPrepared(pm.data, key); nil != pf.err {
+				return
+			}
+		}
+
+		header := ws.Header{Fin: true, OpCode: pm.opCode, Length: int64(len(pf.payload))}
+		if key.compressed {
+			header.Rsv = ws.Rsv(true, false, false)
+		}
+
+		buffer := bytes.NewBuffer(make([]byte, 0, ws.HeaderSize(header)+len(pf.payload)))
+		if pf.err = ws.WriteHeader(buffer, header); nil == pf.err {
+			buffer.Write(pf.payload)
+			pf.frame = buffer.Bytes()
+		}
+	})
+
+	return pf, pf.err
+}
+
+func compressPrepared(data []byte, key preparedKey) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	fw := wsutils.NewFlateWriter(&buffer, func(w io.Writer) wsflate.Compressor {
+		if key.windowBits > 0 {
+			c, _ := kpflate.NewWriterWindow(w, 1<<uint(key.windowBits))
+			return c
+		}
+		c, _ := flate.NewWriter(w, key.level)
+		return c
+	})
+
+	if _, err := fw.Write(data); nil != err {
+		return nil, err
+	}
+
+	if err := fw.Flush(); nil != err {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// WritePreparedMessage writes a prepared message, server side connections copy
+// the cached frame, client side connections only mask the cached payload.
+func (t *websocketTransport) WritePreparedMessage(pm *PreparedMessage) error {
+
+	key := preparedKey{}
+	if key.compressed = t.options.CompressEnabled && t.negotiated.enabled && int64(len(pm.data)) >= t.options.CompressThreshold; key.compressed {
+		key.level = t.options.CompressLevel
+		key.windowBits = t.localWindowBits()
+	}
+
+	pf, err := pm.frame(key)
+	if nil != err {
+		return err
+	}
+
+	t.messageLocker.Lock()
+	defer t.messageLocker.Unlock()
+
+	if key.compressed && nil != t.persistentFlateWriter {
+		// the peer's window now holds the message, which our writer never saw,
+		// so its next message must not refer to the previous ones.
+		defer t.persistentFlateWriter.ResetContext()
+	}
+
+	if t.state.ClientSide() {
+		return t.writeFrame(pm.opCode, true, key.compressed, pf.payload)
+	}
+
+	t.writeLocker.Lock()
+	defer t.writeLocker.Unlock()
+	return t.writeFrames(pf.frame)
+}
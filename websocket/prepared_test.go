@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+func testPreparedMessage(t *testing.T, opts *Options, hs ws.Handshake) {
+	pm, err := NewPreparedMessage(ws.OpText, bytes.Repeat([]byte("market-data;"), 256))
+	if err != nil {
+		t.Fatalf("new prepared message error: %v", err)
+	}
+
+	// fan out on both sides, twice each to hit the cached frame
+	for i := 0; i < 2; i++ {
+		client, server := newTransportPair(t, opts, hs)
+		for _, pair := range [][2]*websocketTransport{{server, client}, {client, server}} {
+			writer, reader := pair[0], pair[1]
+			go func() { _ = writer.WritePreparedMessage(pm) }()
+
+			got, err := io.ReadAll(readerFunc(reader.Read))
+			if err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+			if !bytes.Equal(got, pm.data) {
+				t.Fatalf("unexpected payload: got %d bytes, want %d bytes", len(got), len(pm.data))
+			}
+		}
+	}
+}
+
+func TestPreparedMessage(t *testing.T) {
+	testPreparedMessage(t, DefaultOptions, ws.Handshake{})
+}
+
+func TestPreparedMessage_Compressed(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{
+			ServerNoContextTakeover: true,
+			ClientNoContextTakeover: true,
+			ServerMaxWindowBits:     10,
+		}).Option()},
+	}
+	testPreparedMessage(t, opts.Apply(), hs)
+}
+
+func TestPreparedMessage_ContextTakeover(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+	testPreparedMessage(t, opts.Apply(), hs)
+}
+
+func TestPreparedMessage_ContextTakeoverStream(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+	client, server := newTransportPair(t, opts.Apply(), hs)
+
+	pm, err := NewPreparedMessage(ws.OpText, bytes.Repeat([]byte("market-data;"), 256))
+	if err != nil {
+		t.Fatalf("new prepared message error: %v", err)
+	}
+	update := bytes.Repeat([]byte("market-data;update;"), 64)
+
+	// the messages around the prepared one refer to the compression context
+	writeErr := make(chan error, 1)
+	go func() {
+		for _, write := range []func() error{
+			func() error { _, err := server.Write(update); return err },
+			func() error { return server.WritePreparedMessage(pm) },
+			func() error { _, err := server.Write(update); return err },
+		} {
+			if err := write(); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	for _, want := range [][]byte{update, pm.data, update} {
+		got, err := io.ReadAll(readerFunc(client.Read))
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("unexpected payload: got %d bytes, want %d bytes", len(got), len(want))
+		}
+	}
+	if err = <-writeErr; err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	// the connection wrote the frame compressed for all of them
+	if len(pm.frames) != 1 {
+		t.Fatalf("expected the cached frame to be written, got %d frames", len(pm.frames))
+	}
+	for key := range pm.frames {
+		if !key.compressed {
+			t.Fatalf("expected a compressed frame: %+v", key)
+		}
+	}
+}
+
+func TestPreparedMessage_CachedFrame(t *testing.T) {
+	pm, err := NewPreparedMessage(ws.OpBinary, []byte("cached"))
+	if err != nil {
+		t.Fatalf("new prepared message error: %v", err)
+	}
+
+	first, _ := pm.frame(preparedKey{})
+	second, _ := pm.frame(preparedKey{})
+	if first != second {
+		t.Fatalf("expected the frame to be encoded once")
+	}
+
+	if _, err = NewPreparedMessage(ws.OpPing, nil); err != ErrUnsupportedOpCode {
+		t.Fatalf("expected ErrUnsupportedOpCode, got: %v", err)
+	}
+}
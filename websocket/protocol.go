@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gobwas/ws"
+)
+
+const headerSecProtocol = "Sec-WebSocket-Protocol"
+
+// ProtocolSelector selects the subprotocol of an incoming connection from the
+// protocols offered by the client, an empty result selects none.
+type ProtocolSelector func(request *http.Request, offered []string) string
+
+// Subprotocol returns the negotiated Sec-WebSocket-Protocol, empty if none.
+func (t *websocketTransport) Subprotocol() string {
+	return t.protocol
+}
+
+// protocolUpgrader returns a copy of upgrader that selects the subprotocol for
+// the request, with Options.SelectProtocol or else from Options.Protocols.
+func protocolUpgrader(upgrader ws.HTTPUpgrader, options *Options, request *http.Request) ws.HTTPUpgrader {
+
+	switch {
+	case nil != options.SelectProtocol:
+		selected := options.SelectProtocol(request, offeredProtocols(request))
+		upgrader.Protocol = func(protocol string) bool {
+			return "" != selected && protocol == selected
+		}
+	case len(options.Protocols) > 0 && nil == upgrader.Protocol:
+		upgrader.Protocol = func(protocol string) bool {
+			for _, p := range options.Protocols {
+				if p == protocol {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return upgrader
+}
+
+// offeredProtocols returns the subprotocols offered by the client in order of preference.
+func offeredProtocols(request *http.Request) (protocols []string) {
+	for _, value := range request.Header.Values(headerSecProtocol) {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); "" != protocol {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/go-netty/go-netty/transport"
+)
+
+func listenWebsocket(t *testing.T, opts *Options) *wsAcceptor {
+	options, err := transport.ParseOptions(context.Background(), "ws://127.0.0.1:0/ws", WithOptions(opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	acceptor, err := New().Listen(options)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { _ = acceptor.Close() })
+	return acceptor.(*wsAcceptor)
+}
+
+func connectWebsocket(t *testing.T, url string, opts *Options) (*websocketTransport, error) {
+	options, err := transport.ParseOptions(context.Background(), url, WithOptions(opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	tt, err := New().Connect(options)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { _ = tt.Close() })
+	return tt.(*websocketTransport), nil
+}
+
+func TestSubprotocol_Negotiation(t *testing.T) {
+	serverOpts := *DefaultOptions
+	serverOpts.SelectProtocol = func(request *http.Request, offered []string) string {
+		for _, protocol := range offered {
+			if protocol == "v2.chat" || protocol == "graphql-transport-ws" {
+				return protocol
+			}
+		}
+		return ""
+	}
+	acceptor := listenWebsocket(t, &serverOpts)
+
+	clientOpts := *DefaultOptions
+	clientOpts.Protocols = []string{"v3.chat", "v2.chat"}
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", &clientOpts)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	if got := client.Subprotocol(); got != "v2.chat" {
+		t.Fatalf("unexpected client subprotocol: %q", got)
+	}
+	if got := server.(Transport).Subprotocol(); got != "v2.chat" {
+		t.Fatalf("unexpected server subprotocol: %q", got)
+	}
+}
+
+func TestSubprotocol_FromProtocolsList(t *testing.T) {
+	serverOpts := *DefaultOptions
+	serverOpts.Protocols = []string{"graphql-transport-ws"}
+	acceptor := listenWebsocket(t, &serverOpts)
+
+	clientOpts := *DefaultOptions
+	clientOpts.Protocols = []string{"graphql-ws", "graphql-transport-ws"}
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", &clientOpts)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+
+	if got := client.Subprotocol(); got != "graphql-transport-ws" {
+		t.Fatalf("unexpected client subprotocol: %q", got)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyFunc returns the proxy for a websocket target URL, a nil URL dials directly.
+// Supported proxy schemes are http and https (HTTP CONNECT) and socks5/socks5h.
+type ProxyFunc func(target *url.URL) (*url.URL, error)
+
+// ProxyURL returns a ProxyFunc that always returns the fixed proxy URL.
+func ProxyURL(fixed *url.URL) ProxyFunc {
+	return func(*url.URL) (*url.URL, error) {
+		return fixed, nil
+	}
+}
+
+// ProxyFromEnvironment returns the proxy of the target from the HTTPS_PROXY
+// (wss), HTTP_PROXY (ws) and NO_PROXY environment variables.
+func ProxyFromEnvironment(target *url.URL) (*url.URL, error) {
+	u := *target
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	default:
+		u.Scheme = "http"
+	}
+	return httpproxy.FromEnvironment().ProxyFunc()(&u)
+}
+
+// proxyDialer returns the dial function tunnelling through the proxy of the
+// target, the TLS and websocket handshakes run over the returned connection.
+func proxyDialer(proxyFunc ProxyFunc, target *url.URL) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+
+	proxyURL, err := proxyFunc(target)
+	if nil != err || nil == proxyURL {
+		return nil, err
+	}
+
+	forward := &net.Dialer{}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialConnect(ctx, forward, proxyURL, addr)
+		}, nil
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if nil != proxyURL.User {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+
+		socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+		if nil != err {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext, nil
+	}
+
+	return nil, fmt.Errorf("websocket: unsupported proxy scheme: %s", proxyURL.Scheme)
+}
+
+// dialConnect opens a tunnel to addr with HTTP CONNECT.
+func dialConnect(ctx context.Context, forward *net.Dialer, proxyURL *url.URL, addr string) (conn net.Conn, err error) {
+
+	proxyAddr := proxyURL.Host
+	if "" == proxyURL.Port() {
+		port := "80"
+		if "https" == proxyURL.Scheme {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	if conn, err = forward.DialContext(ctx, "tcp", proxyAddr); nil != err {
+		return nil, err
+	}
+
+	defer func() {
+		if nil != err {
+			_ = conn.Close()
+		}
+	}()
+
+	if "https" == proxyURL.Scheme {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); nil != err {
+			return conn, err
+		}
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if nil != proxyURL.User {
+		password, _ := proxyURL.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+
+	if err = request.Write(conn); nil != err {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	response, err := http.ReadResponse(br, request)
+	if nil != err {
+		return conn, err
+	}
+	_ = response.Body.Close()
+
+	if http.StatusOK != response.StatusCode {
+		return conn, fmt.Errorf("websocket: proxy CONNECT %s: %s", addr, response.Status)
+	}
+
+	// the proxy must not send anything before the websocket handshake
+	if br.Buffered() > 0 {
+		return conn, fmt.Errorf("websocket: proxy CONNECT %s: unexpected data after response", addr)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func serveProxy(t *testing.T, handle func(conn net.Conn)) (addr string, tunnels *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	tunnels = new(int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				atomic.AddInt32(tunnels, 1)
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), tunnels
+}
+
+func pipeTo(conn net.Conn, target string) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		_ = upstream.Close()
+	}()
+	_, _ = io.Copy(conn, upstream)
+	_ = conn.Close()
+}
+
+// connectProxy is a stand-in HTTP CONNECT proxy requiring basic auth.
+func connectProxy(conn net.Conn) {
+	request, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || request.Method != http.MethodConnect {
+		_ = conn.Close()
+		return
+	}
+	if request.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		_ = conn.Close()
+		return
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	pipeTo(conn, request.Host)
+}
+
+// socks5Proxy is a stand-in SOCKS5 proxy without authentication.
+func socks5Proxy(conn net.Conn) {
+	buf := make([]byte, 262)
+	// greeting: version, methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		_ = conn.Close()
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		_ = conn.Close()
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0})
+
+	// request: version, cmd, rsv, atyp
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		_ = conn.Close()
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		_, _ = io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 4:
+		_, _ = io.ReadFull(conn, buf[:16])
+		host = net.IP(buf[:16]).String()
+	case 3:
+		_, _ = io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		_, _ = io.ReadFull(conn, buf[:n])
+		host = string(buf[:n])
+	default:
+		_ = conn.Close()
+		return
+	}
+	_, _ = io.ReadFull(conn, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipeTo(conn, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+func testProxyDial(t *testing.T, proxyURL string, tunnels *int32) {
+	serverOpts := *DefaultOptions
+	acceptor := listenWebsocket(t, &serverOpts)
+
+	clientOpts := *DefaultOptions
+	clientOpts.ProxyURL = proxyURL
+	if _, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", &clientOpts); err != nil {
+		t.Fatalf("connect through proxy error: %v", err)
+	}
+
+	if atomic.LoadInt32(tunnels) != 1 {
+		t.Fatalf("expected connection through proxy, got %d tunnels", atomic.LoadInt32(tunnels))
+	}
+}
+
+func TestProxy_HTTPConnect(t *testing.T) {
+	addr, tunnels := serveProxy(t, connectProxy)
+	testProxyDial(t, "http://user:pass@"+addr, tunnels)
+}
+
+func TestProxy_HTTPConnectUnauthorized(t *testing.T) {
+	addr, _ := serveProxy(t, connectProxy)
+
+	clientOpts := *DefaultOptions
+	clientOpts.ProxyURL = "http://user:wrong@" + addr
+	if _, err := connectWebsocket(t, "ws://127.0.0.1:1/ws", &clientOpts); err == nil {
+		t.Fatalf("expected proxy authentication failure")
+	}
+}
+
+func TestProxy_SOCKS5(t *testing.T) {
+	addr, tunnels := serveProxy(t, socks5Proxy)
+	testProxyDial(t, "socks5://"+addr, tunnels)
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://proxy.internal:3128")
+	t.Setenv("HTTPS_PROXY", "http://secure-proxy.internal:3128")
+	t.Setenv("NO_PROXY", "direct.example.com")
+
+	for target, want := range map[string]string{
+		"ws://api.example.com/ws":     "http://proxy.internal:3128",
+		"wss://api.example.com/ws":    "http://secure-proxy.internal:3128",
+		"wss://direct.example.com/ws": "",
+	} {
+		u, _ := url.Parse(target)
+		got, err := ProxyFromEnvironment(u)
+		if err != nil {
+			t.Fatalf("proxy from environment error: %v", err)
+		}
+		if (got == nil && want != "") || (got != nil && got.String() != want) {
+			t.Fatalf("unexpected proxy for %s: %v, want %q", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/go-netty/go-netty/utils/pool/pbytes"
+)
+
+// QueuePolicy selects what a write does when the outbound queue is full, see
+// Options.WriteQueueMessages and Options.WriteQueueBytes.
+type QueuePolicy int
+
+const (
+	// QueueBlock blocks the write until the queue has room or the write
+	// deadline expires.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest drops the oldest queued messages to make room.
+	QueueDropOldest
+	// QueueClose fails the write with ErrWriteQueueFull and closes the
+	// connection with 1008 Policy Violation.
+	QueueClose
+)
+
+// ErrWriteQueueFull is returned by the writes of a connection closed by the
+// QueueClose policy.
+var ErrWriteQueueFull = errors.New("websocket: write queue full")
+
+// queueEntry is a write, message is set if it holds the frames of a whole data
+// message that may be dropped.
+type queueEntry struct {
+	data    *[]byte
+	message bool
+}
+
+// writeQueue queues the writes of a connection for a single writer goroutine,
+// which writes all the queued frames at once. Control frames and the fragments
+// of a streaming message are never dropped, they wait for room instead.
+type writeQueue struct {
+	transport.Transport
+	maxMessages int
+	maxBytes    int
+	policy      QueuePolicy
+	onOverflow  func()
+	locker      sync.Mutex
+	entries     []queueEntry
+	queued      int
+	// closed and replaced when room is made or the deadline changes
+	changed       chan struct{}
+	writeDeadline time.Time
+	ready         chan struct{}
+	overflowed    bool
+	closing       bool
+	err           error
+	done          chan struct{}
+}
+
+func newWriteQueue(t transport.Transport, options *Options, onOverflow func()) *writeQueue {
+	q := &writeQueue{
+		Transport:   t,
+		maxMessages: options.WriteQueueMessages,
+		maxBytes:    options.WriteQueueBytes,
+		policy:      options.WriteQueuePolicy,
+		onOverflow:  onOverflow,
+		changed:     make(chan struct{}),
+		ready:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Write queues p, which is not dropped by QueueDropOldest.
+func (q *writeQueue) Write(p []byte) (int, error) {
+	if err := q.push(p, false); nil != err {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writev queues the buffers as one write.
+func (q *writeQueue) Writev(buffs transport.Buffers) (int64, error) {
+	var size int
+	for _, buff := range buffs {
+		size += len(buff)
+	}
+
+	data := pbytes.Get(size)
+	*data = (*data)[:0]
+	for _, buff := range buffs {
+		*data = append(*data, buff...)
+	}
+
+	if err := q.enqueue(queueEntry{data: data}); nil != err {
+		pbytes.Put(data)
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// writeMessage queues the frames of a whole data message.
+func (q *writeQueue) writeMessage(frames []byte) error {
+	return q.push(frames, true)
+}
+
+func (q *writeQueue) push(p []byte, message bool) error {
+	data := pbytes.Get(len(p))
+	*data = append((*data)[:0], p...)
+
+	if err := q.enqueue(queueEntry{data: data, message: message}); nil != err {
+		pbytes.Put(data)
+		return err
+	}
+	return nil
+}
+
+func (q *writeQueue) enqueue(entry queueEntry) error {
+	for {
+		q.locker.Lock()
+		switch {
+		case nil != q.err:
+			q.locker.Unlock()
+			return q.err
+		case q.closing:
+			q.locker.Unlock()
+			return net.ErrClosed
+		case entry.message && q.overflowed:
+			q.locker.Unlock()
+			return ErrWriteQueueFull
+		}
+
+		if !q.fits(len(*entry.data)) && entry.message {
+			switch q.policy {
+			case QueueDropOldest:
+				q.dropMessages(len(*entry.data))
+			case QueueClose:
+				// the connection is closed, its queued messages are not needed
+				q.overflowed = true
+				q.dropMessages(-1)
+				q.locker.Unlock()
+				q.onOverflow()
+				return ErrWriteQueueFull
+			}
+		}
+
+		if q.fits(len(*entry.data)) {
+			q.entries = append(q.entries, entry)
+			q.queued += len(*entry.data)
+			q.locker.Unlock()
+			signal(q.ready)
+			return nil
+		}
+
+		changed, deadline := q.changed, q.writeDeadline
+		q.locker.Unlock()
+
+		expired, stop := after(deadline)
+		select {
+		case <-changed:
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		}
+		stop()
+	}
+}
+
+// fits reports whether n more bytes may be queued, an empty queue takes any
+// write. The locker must be held.
+func (q *writeQueue) fits(n int) bool {
+	if 0 == len(q.entries) {
+		return true
+	}
+	if q.maxMessages > 0 && len(q.entries) >= q.maxMessages {
+		return false
+	}
+	return q.maxBytes <= 0 || q.queued+n <= q.maxBytes
+}
+
+// dropMessages drops the oldest messages until n more bytes fit, or all of
+// them if n is negative. The locker must be held.
+func (q *writeQueue) dropMessages(n int) {
+	for i := 0; i < len(q.entries) && (n < 0 || !q.fits(n)); {
+		entry := q.entries[i]
+		if !entry.message {
+			i++
+			continue
+		}
+
+		q.queued -= len(*entry.data)
+		pbytes.Put(entry.data)
+		copy(q.entries[i:], q.entries[i+1:])
+		q.entries[len(q.entries)-1] = queueEntry{}
+		q.entries = q.entries[:len(q.entries)-1]
+	}
+}
+
+// run writes the queued entries until the queue is closed or a write fails.
+func (q *writeQueue) run() {
+	defer close(q.done)
+
+	var spare []queueEntry
+	buffs := make(transport.Buffers, 0, 16)
+	for range q.ready {
+		for {
+			q.locker.Lock()
+			batch, closing := q.entries, q.closing
+			q.entries, q.queued = spare[:0], 0
+			q.notify()
+			q.locker.Unlock()
+
+			if 0 == len(batch) {
+				if closing {
+					return
+				}
+				break
+			}
+
+			buffs = buffs[:0]
+			for _, entry := range batch {
+				buffs = append(buffs, *entry.data)
+			}
+
+			_, err := q.Transport.Writev(buffs)
+			if nil == err {
+				err = q.Transport.Flush()
+			}
+
+			for i, entry := range batch {
+				pbytes.Put(entry.data)
+				batch[i] = queueEntry{}
+			}
+			spare = batch
+
+			if nil != err {
+				q.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// fail drops the queued entries, the following writes return err.
+func (q *writeQueue) fail(err error) {
+	q.locker.Lock()
+	q.err = err
+	for _, entry := range q.entries {
+		pbytes.Put(entry.data)
+	}
+	q.entries, q.queued = nil, 0
+	q.notify()
+	q.locker.Unlock()
+
+	// the read loop sees the broken connection
+	_ = q.Transport.Close()
+}
+
+// notify wakes up the waiting writes, the locker must be held.
+func (q *writeQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Flush returns the error of the last write, the writer goroutine flushes
+// every batch it writes.
+func (q *writeQueue) Flush() error {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	return q.err
+}
+
+func (q *writeQueue) SetDeadline(deadline time.Time) error {
+	q.setWriteDeadline(deadline)
+	return q.Transport.SetDeadline(deadline)
+}
+
+// SetWriteDeadline applies to the waiting writes and to the writer goroutine.
+func (q *writeQueue) SetWriteDeadline(deadline time.Time) error {
+	q.setWriteDeadline(deadline)
+	return q.Transport.SetWriteDeadline(deadline)
+}
+
+func (q *writeQueue) setWriteDeadline(deadline time.Time) {
+	q.locker.Lock()
+	q.writeDeadline = deadline
+	q.notify()
+	q.locker.Unlock()
+}
+
+// Close writes the queued entries, waiting up to closeWriteTimeout for them,
+// and closes the connection.
+func (q *writeQueue) Close() error {
+	q.locker.Lock()
+	q.closing = true
+	q.notify()
+	q.locker.Unlock()
+	signal(q.ready)
+
+	timer := time.NewTimer(closeWriteTimeout)
+	select {
+	case <-q.done:
+	case <-timer.C:
+	}
+	timer.Stop()
+
+	return q.Transport.Close()
+}
@@ -0,0 +1,263 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+// newPipeQueue returns a queue of two entries writing to a pipe, its writer is
+// stuck until the peer end is read.
+func newPipeQueue(t *testing.T, policy QueuePolicy) (*writeQueue, net.Conn, chan struct{}) {
+	local, remote := net.Pipe()
+	opts := *DefaultOptions
+	opts.WriteQueueMessages = 2
+	opts.WriteQueuePolicy = policy
+
+	overflowed := make(chan struct{}, 1)
+	q := newWriteQueue(transport.NewTransport(local, 0, 0), &opts, func() { overflowed <- struct{}{} })
+	t.Cleanup(func() {
+		_ = remote.Close()
+		_ = q.Close()
+	})
+
+	// the first write is taken by the writer, which blocks on the pipe
+	if err := q.writeMessage([]byte("1")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		q.locker.Lock()
+		taken := 0 == len(q.entries)
+		q.locker.Unlock()
+		if taken {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the writer did not take the first write")
+		}
+	}
+	return q, remote, overflowed
+}
+
+func expectPipe(t *testing.T, remote net.Conn, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(remote, got); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("unexpected writes: %q, want %q", got, want)
+	}
+}
+
+func TestWriteQueue_Block(t *testing.T) {
+	q, remote, _ := newPipeQueue(t, QueueBlock)
+
+	for _, p := range []string{"2", "3"} {
+		if err := q.writeMessage([]byte(p)); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- q.writeMessage([]byte("4")) }()
+	select {
+	case err := <-blocked:
+		t.Fatalf("expected the write to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	expectPipe(t, remote, "1234")
+	if err := <-blocked; err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+}
+
+func TestWriteQueue_DropOldest(t *testing.T) {
+	q, remote, _ := newPipeQueue(t, QueueDropOldest)
+
+	// control frames are never dropped
+	if _, err := q.Write([]byte("c")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	for _, p := range []string{"2", "3", "4"} {
+		if err := q.writeMessage([]byte(p)); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+
+	expectPipe(t, remote, "1c4")
+}
+
+func TestWriteQueue_Close(t *testing.T) {
+	q, remote, overflowed := newPipeQueue(t, QueueClose)
+
+	for _, p := range []string{"2", "3"} {
+		if err := q.writeMessage([]byte(p)); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	if err := q.writeMessage([]byte("4")); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("expected ErrWriteQueueFull, got %v", err)
+	}
+	<-overflowed
+
+	if err := q.writeMessage([]byte("5")); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("expected ErrWriteQueueFull, got %v", err)
+	}
+	// the close frame is still written
+	if _, err := q.Write([]byte("c")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	expectPipe(t, remote, "1c")
+}
+
+func TestWriteQueue_KeepsControlFrames(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	opts := *DefaultOptions
+	opts.WriteQueueMessages = 2
+	opts.WriteQueuePolicy = QueueDropOldest
+	tt, err := newWebsocketTransport(local, opts.Apply(), false, nil, ws.Handshake{})
+	if err != nil {
+		t.Fatalf("new transport error: %v", err)
+	}
+	defer tt.Close()
+
+	// the first message is taken by the writer, which blocks on the pipe
+	if _, err = tt.Write([]byte("1")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		tt.queue.locker.Lock()
+		taken := 0 == len(tt.queue.entries)
+		tt.queue.locker.Unlock()
+		if taken {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the writer did not take the first message")
+		}
+	}
+
+	// the next messages drop each other rather than the queued pong
+	if err = tt.writeFrame(ws.OpPong, true, false, []byte("pong")); err != nil {
+		t.Fatalf("pong error: %v", err)
+	}
+	for _, p := range []string{"2", "3"} {
+		if _, err = tt.Write([]byte(p)); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+
+	for _, want := range []struct {
+		opCode  ws.OpCode
+		payload string
+	}{{ws.OpText, "1"}, {ws.OpPong, "pong"}, {ws.OpText, "3"}} {
+		frame, err := ws.ReadFrame(remote)
+		if err != nil {
+			t.Fatalf("read frame error: %v", err)
+		}
+		if frame.Header.OpCode != want.opCode || string(frame.Payload) != want.payload {
+			t.Fatalf("unexpected frame: %v %q, want %v %q", frame.Header.OpCode, frame.Payload, want.opCode, want.payload)
+		}
+	}
+}
+
+func TestWriteQueue_ConcurrentWriters(t *testing.T) {
+	opts := *DefaultOptions
+	opts.WriteQueueMessages = 16
+	opts.WriteQueueBytes = 4096
+	acceptor := listenWebsocket(t, &opts)
+
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", DefaultOptions)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	accepted, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	server := accepted.(*websocketTransport)
+	defer server.Close()
+
+	const writers, messages = 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				payload := fmt.Sprintf("%d:%d:%s", w, i, strings.Repeat("x", i))
+				if _, err := server.Write([]byte(payload)); err != nil {
+					t.Errorf("write error: %v", err)
+					return
+				}
+				_ = server.Flush()
+			}
+		}(w)
+	}
+
+	next := make([]int, writers)
+	for n := 0; n < writers*messages; n++ {
+		got, err := io.ReadAll(readerFunc(client.Read))
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		var w, i int
+		if _, err = fmt.Sscanf(string(got), "%d:%d:", &w, &i); err != nil || i != next[w] {
+			t.Fatalf("unexpected message %q, want %d:%d", got, w, next[w])
+		}
+		next[w]++
+	}
+	wg.Wait()
+}
+
+func TestWriteQueue_ClosesSlowConsumer(t *testing.T) {
+	opts := *DefaultOptions
+	opts.WriteQueueMessages = 8
+	opts.WriteQueuePolicy = QueueClose
+	acceptor := listenWebsocket(t, &opts)
+
+	client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+"/ws", DefaultOptions)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	// nobody reads until the socket buffers are full
+	payload := make([]byte, 64*1024)
+	for i := 0; ; i++ {
+		if _, err = server.Write(payload); err != nil {
+			break
+		}
+		if i > 4096 {
+			t.Fatalf("expected the queue to overflow")
+		}
+	}
+	if !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatalf("expected ErrWriteQueueFull, got %v", err)
+	}
+
+	for {
+		if _, err = io.Copy(io.Discard, readerFunc(client.Read)); err != nil {
+			break
+		}
+	}
+	if !IsCloseError(err, ws.StatusPolicyViolation) {
+		t.Fatalf("expected 1008 Policy Violation, got %v", err)
+	}
+}
@@ -0,0 +1,504 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// ErrMessageInterrupted is returned by Read when the connection was lost while a
+// message was partly read, the next Read starts with a message of the new
+// connection.
+var ErrMessageInterrupted = errors.New("websocket: message interrupted by a reconnect")
+
+// finalCloseCodes are the close codes of a server that doesn't want the client
+// back, its connection is not dialed again.
+var finalCloseCodes = []ws.StatusCode{
+	ws.StatusNormalClosure,
+	ws.StatusProtocolError,
+	ws.StatusUnsupportedData,
+	ws.StatusInvalidFramePayloadData,
+	ws.StatusPolicyViolation,
+	ws.StatusMessageTooBig,
+	ws.StatusMandatoryExt,
+}
+
+// ReconnectOptions makes the client transport dial again when its connection
+// is lost, so the channel outlives server restarts. The first dial of Connect
+// is not retried.
+type ReconnectOptions struct {
+	// MinBackoff is the delay before the first attempt, 500ms if zero. It is
+	// doubled after every failed attempt up to MaxBackoff, 30s if zero.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Jitter randomizes every delay by up to this fraction of it.
+	Jitter float64
+
+	// MaxAttempts gives up after that many failed attempts per disconnection,
+	// zero retries forever. The channel is closed when it gives up.
+	MaxAttempts int
+
+	// Header returns the headers of every handshake request, such as a fresh
+	// token. They replace the headers of WithHeader with the same name.
+	Header func(ctx context.Context) (http.Header, error)
+
+	// ShouldReconnect reports whether the connection lost with err is dialed
+	// again. By default all are, except a close from the server with 1000
+	// Normal Closure or for a protocol or policy violation. Timeouts of the
+	// deadlines are returned to the caller and never reconnect.
+	ShouldReconnect func(err error) bool
+
+	// OnDisconnected is called when the connection is lost.
+	OnDisconnected func(err error)
+
+	// OnReconnecting is called before waiting for the delay of an attempt.
+	OnReconnecting func(attempt int, delay time.Duration)
+
+	// OnReconnected is called once an attempt succeeded.
+	OnReconnected func(attempt int)
+}
+
+// backoff returns the delay before the attempt.
+func (o *ReconnectOptions) backoff(attempt int) time.Duration {
+	minBackoff, maxBackoff := o.MinBackoff, o.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	delay := minBackoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	if o.Jitter > 0 {
+		delay += time.Duration(float64(delay) * o.Jitter * (2*rand.Float64() - 1))
+	}
+	return delay
+}
+
+// shouldReconnect reports whether the connection lost with err is dialed again.
+func (o *ReconnectOptions) shouldReconnect(err error) bool {
+	if nil != o.ShouldReconnect {
+		return o.ShouldReconnect(err)
+	}
+	return !IsCloseError(err, finalCloseCodes...)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// reconnectingTransport is a client transport that replaces its connection
+// when a read or a write fails, the reads and writes wait while it is
+// reconnecting.
+type reconnectingTransport struct {
+	options *ReconnectOptions
+	dial    func() (Transport, error)
+	locker  sync.Mutex
+	current Transport
+	// set by the reader while a message is partly read
+	partial bool
+	// closed while current is connected
+	ready chan struct{}
+	// deadlines applied to the next connections
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+var _ Transport = (*reconnectingTransport)(nil)
+
+func dialReconnecting(factory *websocketFactory, options *transport.Options, reconnect *ReconnectOptions) (*reconnectingTransport, error) {
+
+	dial := func() (Transport, error) {
+		if nil == reconnect.Header {
+			return factory.connect(options)
+		}
+
+		header, err := reconnect.Header(options.Context)
+		if nil != err {
+			return nil, err
+		}
+
+		merged := headerFromContext(options.Context).Clone()
+		if nil == merged {
+			merged = make(http.Header, len(header))
+		}
+		for key, values := range header {
+			merged[http.CanonicalHeaderKey(key)] = values
+		}
+
+		dialOptions := *options
+		dialOptions.Context = context.WithValue(options.Context, headerContextKey{}, merged)
+		return factory.connect(&dialOptions)
+	}
+
+	current, err := dial()
+	if nil != err {
+		return nil, err
+	}
+
+	ready := make(chan struct{})
+	close(ready)
+
+	return &reconnectingTransport{
+		options: reconnect,
+		dial:    dial,
+		current: current,
+		ready:   ready,
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+func (t *reconnectingTransport) transport() Transport {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.current
+}
+
+// connected returns the connection once it is connected, it fails when the
+// transport is closed or gave up reconnecting.
+func (t *reconnectingTransport) connected() (Transport, error) {
+	for {
+		t.locker.Lock()
+		current, ready := t.current, t.ready
+		t.locker.Unlock()
+
+		select {
+		case <-ready:
+			return current, nil
+		default:
+		}
+
+		select {
+		case <-ready:
+		case <-t.closed:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// reconnect replaces the lost connection, cause is returned when it gives up.
+// The reader and the writers may lose the same connection, only the first of
+// them dials and the others wait for it.
+func (t *reconnectingTransport) reconnect(lost Transport, cause error) error {
+
+	t.locker.Lock()
+	select {
+	case <-t.closed:
+		t.locker.Unlock()
+		return cause
+	default:
+	}
+	if lost != t.current {
+		// already replaced
+		t.locker.Unlock()
+		return nil
+	}
+	select {
+	case <-t.ready:
+	default:
+		t.locker.Unlock()
+		if _, err := t.connected(); nil != err {
+			return cause
+		}
+		return nil
+	}
+	t.ready = make(chan struct{})
+	t.locker.Unlock()
+
+	_ = lost.Close()
+
+	if nil != t.options.OnDisconnected {
+		t.options.OnDisconnected(cause)
+	}
+
+	for attempt := 1; 0 == t.options.MaxAttempts || attempt <= t.options.MaxAttempts; attempt++ {
+		delay := t.options.backoff(attempt)
+		if nil != t.options.OnReconnecting {
+			t.options.OnReconnecting(attempt, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-t.closed:
+			timer.Stop()
+			return cause
+		case <-timer.C:
+		}
+
+		next, err := t.dial()
+		if nil != err {
+			continue
+		}
+
+		t.locker.Lock()
+		select {
+		case <-t.closed:
+			t.locker.Unlock()
+			_ = next.Close()
+			return cause
+		default:
+		}
+		if !t.readDeadline.IsZero() {
+			_ = next.SetReadDeadline(t.readDeadline)
+		}
+		if !t.writeDeadline.IsZero() {
+			_ = next.SetWriteDeadline(t.writeDeadline)
+		}
+		t.current = next
+		close(t.ready)
+		t.locker.Unlock()
+
+		if nil != t.options.OnReconnected {
+			t.options.OnReconnected(attempt)
+		}
+		return nil
+	}
+
+	// gave up, the waiting writes fail
+	t.shutdown()
+	return cause
+}
+
+func (t *reconnectingTransport) shutdown() {
+	t.closeOnce.Do(func() {
+		t.locker.Lock()
+		close(t.closed)
+		t.locker.Unlock()
+	})
+}
+
+func (t *reconnectingTransport) Read(p []byte) (int, error) {
+	for {
+		current, err := t.connected()
+		if nil != err {
+			return 0, err
+		}
+
+		n, err := current.Read(p)
+		if nil == err || io.EOF == err {
+			t.partial = nil == err
+			return n, err
+		}
+
+		if err = t.lost(current, err); nil != err {
+			return n, err
+		}
+
+		if t.partial || n > 0 {
+			// the rest of the message is gone with the connection
+			t.partial = false
+			return 0, ErrMessageInterrupted
+		}
+	}
+}
+
+// lost handles the error of the connection: timeouts are returned, the final
+// errors close the transport and the others reconnect.
+func (t *reconnectingTransport) lost(current Transport, err error) error {
+	if isTimeout(err) {
+		return err
+	}
+	if !t.options.shouldReconnect(err) {
+		t.shutdown()
+		_ = current.Close()
+		return err
+	}
+	return t.reconnect(current, err)
+}
+
+// write runs fn on the connection, it runs again on the next connection when
+// the connection is lost.
+func (t *reconnectingTransport) write(fn func(current Transport) error) error {
+	for {
+		current, err := t.connected()
+		if nil != err {
+			return err
+		}
+
+		if err = fn(current); nil == err {
+			return nil
+		}
+
+		if err = t.lost(current, err); nil != err {
+			return err
+		}
+	}
+}
+
+func (t *reconnectingTransport) Write(p []byte) (n int, err error) {
+	err = t.write(func(current Transport) (err error) {
+		n, err = current.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (t *reconnectingTransport) Writev(buffs transport.Buffers) (n int64, err error) {
+	err = t.write(func(current Transport) (err error) {
+		n, err = current.Writev(buffs)
+		return err
+	})
+	return n, err
+}
+
+func (t *reconnectingTransport) WriteMessage(opCode ws.OpCode, p []byte) (n int, err error) {
+	if ws.OpText != opCode && ws.OpBinary != opCode {
+		return 0, ErrUnsupportedOpCode
+	}
+	err = t.write(func(current Transport) (err error) {
+		n, err = current.WriteMessage(opCode, p)
+		return err
+	})
+	return n, err
+}
+
+// NextWriter returns a writer of the connection, its writes are not retried on
+// the next connection.
+func (t *reconnectingTransport) NextWriter(opCode ws.OpCode) (w io.WriteCloser, err error) {
+	if ws.OpText != opCode && ws.OpBinary != opCode {
+		return nil, ErrUnsupportedOpCode
+	}
+	err = t.write(func(current Transport) (err error) {
+		w, err = current.NextWriter(opCode)
+		return err
+	})
+	return w, err
+}
+
+func (t *reconnectingTransport) WritePreparedMessage(pm *PreparedMessage) error {
+	return t.write(func(current Transport) error {
+		return current.WritePreparedMessage(pm)
+	})
+}
+
+// Flush flushes the connection, the writes buffered by a lost connection are
+// lost with it.
+func (t *reconnectingTransport) Flush() error {
+	return t.write(func(current Transport) error {
+		return current.Flush()
+	})
+}
+
+// Close closes the connection and stops reconnecting.
+func (t *reconnectingTransport) Close() error {
+	t.shutdown()
+	return t.transport().Close()
+}
+
+// GracefulClose performs the close handshake and stops reconnecting.
+func (t *reconnectingTransport) GracefulClose(code int, reason string) error {
+	t.shutdown()
+	return t.transport().GracefulClose(code, reason)
+}
+
+func (t *reconnectingTransport) SetDeadline(deadline time.Time) error {
+	if err := t.SetReadDeadline(deadline); nil != err {
+		return err
+	}
+	return t.SetWriteDeadline(deadline)
+}
+
+func (t *reconnectingTransport) SetReadDeadline(deadline time.Time) error {
+	t.locker.Lock()
+	t.readDeadline = deadline
+	current := t.current
+	t.locker.Unlock()
+	return current.SetReadDeadline(deadline)
+}
+
+func (t *reconnectingTransport) SetWriteDeadline(deadline time.Time) error {
+	t.locker.Lock()
+	t.writeDeadline = deadline
+	current := t.current
+	t.locker.Unlock()
+	return current.SetWriteDeadline(deadline)
+}
+
+func (t *reconnectingTransport) LocalAddr() net.Addr {
+	return t.transport().LocalAddr()
+}
+
+func (t *reconnectingTransport) RemoteAddr() net.Addr {
+	return t.transport().RemoteAddr()
+}
+
+func (t *reconnectingTransport) RawTransport() interface{} {
+	return t.transport().RawTransport()
+}
+
+func (t *reconnectingTransport) Route() string {
+	return t.transport().Route()
+}
+
+func (t *reconnectingTransport) Header() http.Header {
+	return t.transport().Header()
+}
+
+func (t *reconnectingTransport) Request() *http.Request {
+	return t.transport().Request()
+}
+
+func (t *reconnectingTransport) Subprotocol() string {
+	return t.transport().Subprotocol()
+}
+
+func (t *reconnectingTransport) Attachment() interface{} {
+	return t.transport().Attachment()
+}
+
+func (t *reconnectingTransport) Response() *http.Response {
+	return t.transport().Response()
+}
+
+func (t *reconnectingTransport) TLS() *tls.ConnectionState {
+	return t.transport().TLS()
+}
+
+func (t *reconnectingTransport) MessageOpCode() ws.OpCode {
+	return t.transport().MessageOpCode()
+}
+
+func (t *reconnectingTransport) RTT() time.Duration {
+	return t.transport().RTT()
+}
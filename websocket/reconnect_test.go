@@ -0,0 +1,269 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+func TestReconnectOptions_Backoff(t *testing.T) {
+	o := &ReconnectOptions{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 50: time.Second} {
+		if got := o.backoff(attempt); got != want {
+			t.Fatalf("attempt %d: got %v, want %v", attempt, got, want)
+		}
+	}
+
+	o.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := o.backoff(2); got < 100*time.Millisecond || got > 300*time.Millisecond {
+			t.Fatalf("jittered delay out of range: %v", got)
+		}
+	}
+}
+
+func listenAt(t *testing.T, address string) *wsAcceptor {
+	options, err := transport.ParseOptions(context.Background(), "ws://"+address+"/ws", WithOptions(DefaultOptions))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	acceptor, err := New().Listen(options)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { _ = acceptor.Close() })
+	return acceptor.(*wsAcceptor)
+}
+
+func dialReconnect(t *testing.T, address string, reconnect *ReconnectOptions) *reconnectingTransport {
+	opts := *DefaultOptions
+	opts.Reconnect = reconnect
+	options, err := transport.ParseOptions(context.Background(), "ws://"+address+"/ws", WithOptions(&opts),
+		WithHeader(http.Header{"X-Client": {"dashboard"}}))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	client, err := New().Connect(options)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client.(*reconnectingTransport)
+}
+
+func TestReconnect_ServerRestart(t *testing.T) {
+	acceptor := listenAt(t, "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(acceptor.httpServer.Addr)
+	address := net.JoinHostPort("127.0.0.1", port)
+
+	var tokens, disconnected, reconnecting, reconnected atomic.Int32
+	client := dialReconnect(t, address, &ReconnectOptions{
+		MinBackoff: 20 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Jitter:     0.2,
+		Header: func(ctx context.Context) (http.Header, error) {
+			return http.Header{"Authorization": {fmt.Sprintf("Bearer %d", tokens.Add(1))}}, nil
+		},
+		OnDisconnected: func(err error) { disconnected.Add(1) },
+		OnReconnecting: func(attempt int, delay time.Duration) { reconnecting.Add(1) },
+		OnReconnected:  func(attempt int) { reconnected.Add(1) },
+	})
+
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	roundTrip(t, server.(Transport), client, "before restart")
+
+	// the reads wait while reconnecting
+	received := make(chan string, 1)
+	go func() {
+		got, _ := io.ReadAll(readerFunc(client.Read))
+		received <- string(got)
+	}()
+
+	_ = server.Close()
+	_ = acceptor.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	acceptor = listenAt(t, address)
+	server, err = acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	header := server.(Transport).Header()
+	if header.Get("Authorization") != fmt.Sprintf("Bearer %d", tokens.Load()) || header.Get("X-Client") != "dashboard" {
+		t.Fatalf("unexpected handshake headers: %v", header)
+	}
+
+	if _, err = server.(Transport).WriteMessage(DefaultOptions.OpCode, []byte("after restart")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if got := <-received; got != "after restart" {
+		t.Fatalf("unexpected message: %q", got)
+	}
+	roundTrip(t, client, server.(Transport), "client writes again")
+
+	if disconnected.Load() != 1 || reconnecting.Load() < 1 || reconnected.Load() != 1 {
+		t.Fatalf("unexpected callbacks: disconnected %d, reconnecting %d, reconnected %d", disconnected.Load(), reconnecting.Load(), reconnected.Load())
+	}
+}
+
+func TestReconnect_GivesUp(t *testing.T) {
+	acceptor := listenAt(t, "127.0.0.1:0")
+
+	var attempts atomic.Int32
+	client := dialReconnect(t, acceptor.httpServer.Addr, &ReconnectOptions{
+		MinBackoff:     10 * time.Millisecond,
+		MaxAttempts:    2,
+		OnReconnecting: func(attempt int, delay time.Duration) { attempts.Add(1) },
+	})
+
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	_ = acceptor.Close()
+	_ = server.Close()
+
+	if _, err = io.ReadAll(readerFunc(client.Read)); err == nil {
+		t.Fatalf("expected the read to fail")
+	}
+	if attempts.Load() != 2 {
+		t.Fatalf("unexpected attempts: %d", attempts.Load())
+	}
+	if _, err = client.Write([]byte("gone")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+}
+
+func TestReconnect_ReadTimeout(t *testing.T) {
+	acceptor := listenAt(t, "127.0.0.1:0")
+
+	var disconnected atomic.Int32
+	client := dialReconnect(t, acceptor.httpServer.Addr, &ReconnectOptions{
+		MinBackoff:     10 * time.Millisecond,
+		OnDisconnected: func(err error) { disconnected.Add(1) },
+	})
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	_ = client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = client.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the deadline to expire, got %v", err)
+	}
+	if disconnected.Load() != 0 {
+		t.Fatalf("expected the timeout not to reconnect")
+	}
+
+	_ = client.SetReadDeadline(time.Time{})
+	roundTrip(t, server.(Transport), client, "same connection")
+}
+
+func TestReconnect_NormalClosure(t *testing.T) {
+	acceptor := listenAt(t, "127.0.0.1:0")
+
+	var disconnected atomic.Int32
+	client := dialReconnect(t, acceptor.httpServer.Addr, &ReconnectOptions{
+		MinBackoff:     10 * time.Millisecond,
+		OnDisconnected: func(err error) { disconnected.Add(1) },
+	})
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	go func() { _ = server.(Transport).GracefulClose(int(ws.StatusNormalClosure), "done") }()
+	if _, err = client.Read(make([]byte, 1)); !IsCloseError(err, ws.StatusNormalClosure) {
+		t.Fatalf("expected the close message, got %v", err)
+	}
+	if disconnected.Load() != 0 {
+		t.Fatalf("expected the normal closure not to reconnect")
+	}
+	if _, err = client.Write([]byte("gone")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+}
+
+func TestReconnect_WriteError(t *testing.T) {
+	acceptor := listenAt(t, "127.0.0.1:0")
+
+	var reconnected atomic.Int32
+	client := dialReconnect(t, acceptor.httpServer.Addr, &ReconnectOptions{
+		MinBackoff:    10 * time.Millisecond,
+		OnReconnected: func(attempt int) { reconnected.Add(1) },
+	})
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	// the connection breaks under the writer
+	_ = client.transport().(*websocketTransport).Transport.Close()
+
+	if _, err = client.Write([]byte("after write error")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	next, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer next.Close()
+
+	if got, _ := io.ReadAll(readerFunc(next.Read)); string(got) != "after write error" {
+		t.Fatalf("unexpected message: %q", got)
+	}
+	if reconnected.Load() != 1 {
+		t.Fatalf("unexpected reconnects: %d", reconnected.Load())
+	}
+}
+
+func TestReconnect_InterruptedMessage(t *testing.T) {
+	acceptor := listenAt(t, "127.0.0.1:0")
+
+	client := dialReconnect(t, acceptor.httpServer.Addr, &ReconnectOptions{MinBackoff: 10 * time.Millisecond})
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+
+	// the first fragment of a message, the connection is lost before the rest
+	wt := server.(*websocketTransport)
+	if err = wt.writeFrame(DefaultOptions.OpCode, false, false, []byte("part")); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	_ = wt.Flush()
+
+	p := make([]byte, 64)
+	if n, err := client.Read(p); err != nil || string(p[:n]) != "part" {
+		t.Fatalf("unexpected read: %q, %v", p[:n], err)
+	}
+	_ = server.Close()
+
+	if _, err = client.Read(p); !errors.Is(err, ErrMessageInterrupted) {
+		t.Fatalf("expected the message to be interrupted, got %v", err)
+	}
+
+	next, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer next.Close()
+	roundTrip(t, next.(Transport), client, "next message")
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"errors"
+	"sync"
+)
+
+// Registry tracks the live server transports of the acceptors and upgraders
+// sharing it through Options.Registry, indexed by route and by the tags
+// assigned with Tag. Transports are removed when they are closed.
+type Registry struct {
+	locker  sync.RWMutex
+	entries map[Transport]*registryEntry
+	routes  map[string]map[Transport]struct{}
+	tags    map[string]map[Transport]struct{}
+}
+
+type registryEntry struct {
+	route string
+	tags  map[string]struct{}
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[Transport]*registryEntry),
+		routes:  make(map[string]map[Transport]struct{}),
+		tags:    make(map[string]map[Transport]struct{}),
+	}
+}
+
+func (r *Registry) add(t liveTransport) {
+	route := t.Route()
+
+	r.locker.Lock()
+	r.entries[t] = &registryEntry{route: route}
+	index(r.routes, route, t)
+	r.locker.Unlock()
+
+	t.onRelease(func() { r.remove(t) })
+}
+
+func (r *Registry) remove(t Transport) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	entry, ok := r.entries[t]
+	if !ok {
+		return
+	}
+
+	delete(r.entries, t)
+	unindex(r.routes, entry.route, t)
+	for tag := range entry.tags {
+		unindex(r.tags, tag, t)
+	}
+}
+
+// Tag assigns tags to a registered transport, such as the user it was
+// authenticated as. It returns false if the transport is not registered,
+// e.g. because it has already been closed.
+func (r *Registry) Tag(t Transport, tags ...string) bool {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	entry, ok := r.entries[t]
+	if !ok {
+		return false
+	}
+
+	if nil == entry.tags {
+		entry.tags = make(map[string]struct{}, len(tags))
+	}
+
+	for _, tag := range tags {
+		entry.tags[tag] = struct{}{}
+		index(r.tags, tag, t)
+	}
+	return true
+}
+
+// Untag removes tags from a registered transport.
+func (r *Registry) Untag(t Transport, tags ...string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	entry, ok := r.entries[t]
+	if !ok {
+		return
+	}
+
+	for _, tag := range tags {
+		if _, ok = entry.tags[tag]; ok {
+			delete(entry.tags, tag)
+			unindex(r.tags, tag, t)
+		}
+	}
+}
+
+// Count returns the number of live transports.
+func (r *Registry) Count() int {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return len(r.entries)
+}
+
+// CountRoute returns the number of live transports upgraded on route.
+func (r *Registry) CountRoute(route string) int {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return len(r.routes[route])
+}
+
+// CountTag returns the number of live transports tagged with tag.
+func (r *Registry) CountTag(tag string) int {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return len(r.tags[tag])
+}
+
+// Range calls fn for each live transport until fn returns false. fn is called
+// on a snapshot, so it may close, tag or untag transports.
+func (r *Registry) Range(fn func(t Transport) bool) {
+	r.locker.RLock()
+	snapshot := make([]Transport, 0, len(r.entries))
+	for t := range r.entries {
+		snapshot = append(snapshot, t)
+	}
+	r.locker.RUnlock()
+
+	rangeTransports(snapshot, fn)
+}
+
+// RangeRoute calls fn for each live transport upgraded on route until fn returns false.
+func (r *Registry) RangeRoute(route string, fn func(t Transport) bool) {
+	rangeTransports(r.snapshot(r.routes, route), fn)
+}
+
+// RangeTag calls fn for each live transport tagged with tag until fn returns false.
+func (r *Registry) RangeTag(tag string, fn func(t Transport) bool) {
+	rangeTransports(r.snapshot(r.tags, tag), fn)
+}
+
+// Broadcast writes the prepared message to every live transport.
+//
+// The message is written to one transport after another, so a peer that does
+// not read delays the following ones unless write deadlines are in place. The
+// errors of the failed transports are joined, the others are still written.
+func (r *Registry) Broadcast(pm *PreparedMessage) error {
+	var errs []error
+	r.Range(func(t Transport) bool {
+		errs = appendBroadcastError(errs, t, pm)
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// BroadcastRoute writes the prepared message to every live transport upgraded on route.
+func (r *Registry) BroadcastRoute(route string, pm *PreparedMessage) error {
+	var errs []error
+	r.RangeRoute(route, func(t Transport) bool {
+		errs = appendBroadcastError(errs, t, pm)
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+// BroadcastTag writes the prepared message to every live transport tagged with tag.
+func (r *Registry) BroadcastTag(tag string, pm *PreparedMessage) error {
+	var errs []error
+	r.RangeTag(tag, func(t Transport) bool {
+		errs = appendBroadcastError(errs, t, pm)
+		return true
+	})
+	return errors.Join(errs...)
+}
+
+func (r *Registry) snapshot(idx map[string]map[Transport]struct{}, key string) []Transport {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+
+	set := idx[key]
+	snapshot := make([]Transport, 0, len(set))
+	for t := range set {
+		snapshot = append(snapshot, t)
+	}
+	return snapshot
+}
+
+func rangeTransports(transports []Transport, fn func(t Transport) bool) {
+	for _, t := range transports {
+		if !fn(t) {
+			return
+		}
+	}
+}
+
+func appendBroadcastError(errs []error, t Transport, pm *PreparedMessage) []error {
+	err := t.WritePreparedMessage(pm)
+	if nil == err {
+		err = t.Flush()
+	}
+	if nil != err {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func index(idx map[string]map[Transport]struct{}, key string, t Transport) {
+	set, ok := idx[key]
+	if !ok {
+		set = make(map[Transport]struct{})
+		idx[key] = set
+	}
+	set[t] = struct{}{}
+}
+
+func unindex(idx map[string]map[Transport]struct{}, key string, t Transport) {
+	if set, ok := idx[key]; ok {
+		delete(set, t)
+		if 0 == len(set) {
+			delete(idx, key)
+		}
+	}
+}
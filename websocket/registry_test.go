@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func TestRegistry_RoutesTagsAndBroadcast(t *testing.T) {
+	registry := NewRegistry()
+	opts := *DefaultOptions
+	opts.Routers = []string{"/feed", "/chat"}
+	opts.Registry = registry
+	acceptor := listenWebsocket(t, &opts)
+
+	clients := make(map[string][]*websocketTransport)
+	servers := make(map[*websocketTransport]Transport)
+	for _, route := range []string{"/feed", "/feed", "/chat"} {
+		client, err := connectWebsocket(t, "ws://"+acceptor.httpServer.Addr+route, DefaultOptions)
+		if err != nil {
+			t.Fatalf("connect error: %v", err)
+		}
+		server, err := acceptor.Accept()
+		if err != nil {
+			t.Fatalf("accept error: %v", err)
+		}
+		clients[route] = append(clients[route], client)
+		servers[client] = server.(Transport)
+	}
+
+	if registry.Count() != 3 || registry.CountRoute("/feed") != 2 || registry.CountRoute("/chat") != 1 {
+		t.Fatalf("unexpected counts: %d, feed %d, chat %d", registry.Count(), registry.CountRoute("/feed"), registry.CountRoute("/chat"))
+	}
+
+	tagged := clients["/feed"][0]
+	if !registry.Tag(servers[tagged], "user:1") || registry.CountTag("user:1") != 1 {
+		t.Fatalf("expected tagged transport")
+	}
+
+	expect := func(client *websocketTransport, want string) {
+		t.Helper()
+		got, err := io.ReadAll(readerFunc(client.Read))
+		if err != nil {
+			t.Fatalf("client read error: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("unexpected message: %q, want %q", got, want)
+		}
+	}
+
+	pm, _ := NewPreparedMessage(ws.OpText, []byte("to user"))
+	if err := registry.BroadcastTag("user:1", pm); err != nil {
+		t.Fatalf("broadcast tag error: %v", err)
+	}
+	expect(tagged, "to user")
+
+	pm, _ = NewPreparedMessage(ws.OpText, []byte("to feed"))
+	if err := registry.BroadcastRoute("/feed", pm); err != nil {
+		t.Fatalf("broadcast route error: %v", err)
+	}
+	for _, client := range clients["/feed"] {
+		expect(client, "to feed")
+	}
+
+	pm, _ = NewPreparedMessage(ws.OpText, []byte("to all"))
+	if err := registry.Broadcast(pm); err != nil {
+		t.Fatalf("broadcast error: %v", err)
+	}
+	for client := range servers {
+		expect(client, "to all")
+	}
+
+	// closed transports are removed from every index
+	_ = servers[tagged].Close()
+	if registry.Count() != 2 || registry.CountRoute("/feed") != 1 || registry.CountTag("user:1") != 0 {
+		t.Fatalf("unexpected counts after close: %d, feed %d, user %d", registry.Count(), registry.CountRoute("/feed"), registry.CountTag("user:1"))
+	}
+	if registry.Tag(servers[tagged], "user:2") {
+		t.Fatalf("expected closed transport not to be tagged")
+	}
+
+	var ranged int
+	registry.Range(func(t Transport) bool {
+		ranged++
+		return false
+	})
+	if ranged != 1 {
+		t.Fatalf("expected range to stop, got %d calls", ranged)
+	}
+}
+
+func TestRegistry_Untag(t *testing.T) {
+	registry := NewRegistry()
+	_, server := newTransportPair(t, DefaultOptions, ws.Handshake{})
+	server.request.URL = &url.URL{Path: "/ws"}
+	registry.add(server)
+
+	registry.Tag(server, "a", "b")
+	registry.Untag(server, "a")
+	if registry.CountTag("a") != 0 || registry.CountTag("b") != 1 {
+		t.Fatalf("unexpected tags: a %d, b %d", registry.CountTag("a"), registry.CountTag("b"))
+	}
+
+	var tagged []Transport
+	registry.RangeTag("b", func(t Transport) bool {
+		tagged = append(tagged, t)
+		return true
+	})
+	if len(tagged) != 1 || tagged[0] != Transport(server) {
+		t.Fatalf("unexpected tagged transports: %v", tagged)
+	}
+}
@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/ws"
+)
+
+func newTestCertificate(t *testing.T, name string, usage x509.ExtKeyUsage) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate error: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestConnect_MutualTLS(t *testing.T) {
+	serverCert, serverPool := newTestCertificate(t, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientPool := newTestCertificate(t, "client", x509.ExtKeyUsageClientAuth)
+
+	serverOpts := *DefaultOptions
+	serverOpts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	}
+	options, err := transport.ParseOptions(context.Background(), "wss://127.0.0.1:0/ws", WithOptions(&serverOpts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	acceptor, err := New().Listen(options)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer acceptor.Close()
+	// the listener binds every interface, the certificate is for 127.0.0.1
+	_, port, _ := net.SplitHostPort(acceptor.(*wsAcceptor).httpServer.Addr)
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	// the private CA is not trusted without Options.TLS
+	if _, err = connectWebsocket(t, "wss://"+addr+"/ws", DefaultOptions); err == nil {
+		t.Fatalf("expected untrusted server certificate to fail")
+	}
+
+	clientOpts := *DefaultOptions
+	clientOpts.TLS = &tls.Config{
+		RootCAs:      serverPool,
+		Certificates: []tls.Certificate{clientCert},
+	}
+	client, err := connectWebsocket(t, "wss://"+addr+"/ws", &clientOpts)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	state := client.TLS()
+	if state == nil || !state.HandshakeComplete || state.PeerCertificates[0].Subject.CommonName != "server" {
+		t.Fatalf("unexpected client tls state: %+v", state)
+	}
+	state = server.(Transport).TLS()
+	if state == nil || !state.HandshakeComplete || state.PeerCertificates[0].Subject.CommonName != "client" {
+		t.Fatalf("unexpected server tls state: %+v", state)
+	}
+}
+
+func TestTransport_TLSNilWithoutTLS(t *testing.T) {
+	client, server := newTransportPair(t, DefaultOptions, ws.Handshake{})
+	if client.TLS() != nil || server.TLS() != nil {
+		t.Fatalf("expected no tls state on plain connections")
+	}
+}
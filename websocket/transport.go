@@ -20,12 +20,16 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-netty/go-netty-transport/websocket/internal/wsutils"
 	"github.com/go-netty/go-netty/transport"
@@ -37,15 +41,74 @@ import (
 	kpflate "github.com/klauspost/compress/flate"
 )
 
+// Transport defines the websocket specific methods of the transports created by
+// this package, pipeline handlers can assert the channel transport to it.
+type Transport interface {
+	transport.Transport
+
+	// Route returns the path of the handshake request.
+	Route() string
+
+	// Header returns the headers of the handshake request on the server side,
+	// and of the handshake response on the client side.
+	Header() http.Header
+
+	// Request returns the handshake request.
+	Request() *http.Request
+
+	// Subprotocol returns the negotiated subprotocol.
+	Subprotocol() string
+
+	// Attachment returns the attachment assigned by Options.CheckUpgrade.
+	Attachment() interface{}
+
+	// Response returns the handshake response of a client connection.
+	Response() *http.Response
+
+	// TLS returns the state of the TLS connection, nil if it is not secured.
+	TLS() *tls.ConnectionState
+
+	// MessageOpCode returns the opcode of the inbound message being read.
+	MessageOpCode() ws.OpCode
+
+	// WriteMessage writes p as a single message with the given opcode.
+	WriteMessage(opCode ws.OpCode, p []byte) (int, error)
+
+	// NextWriter returns a writer for a fragmented message with the given opcode.
+	NextWriter(opCode ws.OpCode) (io.WriteCloser, error)
+
+	// WritePreparedMessage writes a message encoded once for many connections.
+	WritePreparedMessage(pm *PreparedMessage) error
+
+	// RTT returns the round trip time measured by keepalive pings.
+	RTT() time.Duration
+
+	// GracefulClose starts the close handshake, the transport is closed once
+	// the peer answers or Options.CloseTimeout expires. It may be called by
+	// the handlers of the read loop.
+	GracefulClose(code int, reason string) error
+}
+
+var _ Transport = (*websocketTransport)(nil)
+
 type websocketTransport struct {
 	transport.Transport
 	options     *Options
 	state       ws.State  // StateClientSide or StateServerSide
 	opCode      ws.OpCode // OpText or OpBinary
+	msgOpCode   ws.OpCode // opcode of the inbound message being read
+	protocol    string    // negotiated subprotocol
+	attachment  interface{}
+	response    *http.Response // handshake response, client side only
+	tlsState    *tls.ConnectionState
+	remoteAddr  net.Addr // client forwarded by a trusted proxy
 	request     *http.Request
 	reader      *wsutils.FrameReader
 	msgReader   io.Reader
 	writeLocker sync.Mutex
+	// serializes data messages, control frames may still be interleaved
+	// between the fragments of a streaming message.
+	messageLocker sync.Mutex
 	// negotiated compression params for this connection
 	negotiated struct {
 		enabled             bool
@@ -57,28 +120,59 @@ type websocketTransport struct {
 	// persistent flate instances (used when context takeover is allowed)
 	persistentFlateReader *wsutils.FlateReader
 	persistentFlateWriter *wsutils.FlateWriter
+	// ping/pong keepalive, nil if disabled
+	keepalive *keepalive
+	// pong reply to the latest ping, written off the read path
+	pongLocker  sync.Mutex
+	pongPayload []byte
+	pongPending bool
+	// close handshake state
+	closeSent     atomic.Bool
+	closeReceived chan struct{}
+	closeOnce     sync.Once
+	// closes the transport if the peer doesn't answer GracefulClose
+	closeTimer atomic.Pointer[time.Timer]
+	// outbound queue of Options.WriteQueueMessages and Options.WriteQueueBytes,
+	// nil if disabled
+	queue *writeQueue
+	// called once when the transport is closed
+	releaseHooks []func()
+	releaseOnce  sync.Once
 }
 
 func newWebsocketTransport(conn net.Conn, wsOptions *Options, client bool, request *http.Request, hs ws.Handshake) (*websocketTransport, error) {
 
-	var err error
-	switch t := conn.(type) {
-	case *net.TCPConn:
-		err = t.SetNoDelay(wsOptions.NoDelay)
-	case *tls.Conn:
-		if tc, ok := t.NetConn().(*net.TCPConn); ok {
-			err = tc.SetNoDelay(wsOptions.NoDelay)
-		}
-	}
-
-	if nil != err {
+	if err := setNoDelay(conn, wsOptions.NoDelay); nil != err {
 		return nil, err
 	}
 
 	t := &websocketTransport{
-		Transport: transport.NewTransport(conn, wsOptions.ReadBufferSize, wsOptions.WriteBufferSize),
-		options:   wsOptions,
-		request:   request,
+		Transport:     transport.NewTransport(conn, wsOptions.ReadBufferSize, wsOptions.WriteBufferSize),
+		options:       wsOptions,
+		request:       request,
+		closeReceived: make(chan struct{}),
+		protocol:      hs.Protocol,
+		tlsState:      connectionState(conn),
+	}
+
+	if wsOptions.WriteQueueMessages > 0 || wsOptions.WriteQueueBytes > 0 {
+		t.queue = newWriteQueue(t.Transport, wsOptions, func() {
+			// the write overflowing the queue holds the writeLocker
+			go t.abort(ws.StatusPolicyViolation, "write queue full")
+		})
+		t.Transport = t.queue
+	}
+
+	if nil == t.tlsState && !client && nil != request {
+		// terminated before the hijacked connection
+		t.tlsState = request.TLS
+	}
+
+	if !client && nil != request && len(wsOptions.trustedProxies) > 0 && request.RemoteAddr != conn.RemoteAddr().String() {
+		// forwarded by a trusted proxy, see resolveRemoteAddr
+		if addr, err := netip.ParseAddrPort(request.RemoteAddr); nil == err {
+			t.remoteAddr = net.TCPAddrFromAddrPort(addr)
+		}
 	}
 
 	// setup opcode
@@ -90,14 +184,31 @@ func newWebsocketTransport(conn net.Conn, wsOptions *Options, client bool, reque
 	if t.state = ws.StateServerSide; client {
 		t.state = ws.StateClientSide
 	}
+	var source io.Reader = t.Transport
+	var onPong func(payload []byte)
+	if wsOptions.PingInterval > 0 || wsOptions.IdleTimeout > 0 {
+		t.keepalive = newKeepalive(t)
+		source = activityReader{Reader: t.Transport, ka: t.keepalive}
+		onPong = t.keepalive.pong
+	}
+
 	// message reader
 	t.reader = &wsutils.FrameReader{
-		Source:          t.Transport,
-		State:           t.state | ws.StateExtended,
-		CheckUTF8:       wsOptions.CheckUTF8,
-		SkipHeaderCheck: false,
-		MaxFrameSize:    wsOptions.MaxFrameSize,
-		OnIntermediate:  wsutils.ControlFrameHandler(t.Transport, &t.writeLocker, t.state),
+		Source:              source,
+		State:               t.state | ws.StateExtended,
+		CheckUTF8:           wsOptions.CheckUTF8,
+		SkipHeaderCheck:     false,
+		MaxFrameSize:        wsOptions.MaxFrameSize,
+		MaxMessageSize:      wsOptions.MaxMessageSize,
+		MaxDecompressedSize: wsOptions.MaxDecompressedSize,
+		OnIntermediate: wsutils.ControlFrameHandler(wsutils.ControlHandler{
+			Dst:          t.Transport,
+			State:        t.state,
+			WriterLocker: &t.writeLocker,
+			OnPong:       onPong,
+			OnPing:       t.onPing,
+			OnClose:      t.onClose,
+		}),
 		GetFlateReader: func(reader io.Reader) *wsutils.FlateReader {
 			flateReader := t.options.flateReaderPool.Get().(*wsutils.FlateReader)
 			flateReader.Reset(reader)
@@ -109,6 +220,11 @@ func newWebsocketTransport(conn net.Conn, wsOptions *Options, client bool, reque
 		},
 	}
 
+	if 0 == t.reader.MaxDecompressedSize {
+		// the inflated message is bounded by the message size limit
+		t.reader.MaxDecompressedSize = wsOptions.MaxMessageSize
+	}
+
 	// If handshake response includes negotiated extensions, parse them.
 	if len(hs.Extensions) > 0 {
 		parsePerMessageDeflate(hs, &t.negotiated)
@@ -121,7 +237,7 @@ func newWebsocketTransport(conn net.Conn, wsOptions *Options, client bool, reque
 		t.reader.Extensions = []wsutil.RecvExtension{perMessageDeflateRecvExt{}}
 
 		// If peer allows context takeover (peer is sender of compressed frames),
-		// try to keep a persistent flate reader to reuse between messages.
+		// keep a persistent flate reader whose window spans the messages.
 		peerNoCtx := false
 		if t.state.ServerSide() {
 			// peer is client
@@ -134,62 +250,100 @@ func newWebsocketTransport(conn net.Conn, wsOptions *Options, client bool, reque
 		if !peerNoCtx {
 			// reuse a flate reader for multiple messages
 			fr := t.options.flateReaderPool.Get().(*wsutils.FlateReader)
+			fr.SetContextTakeover(true)
 			// initialize with nil; GetFlateReader will Reset with real reader later
 			fr.Reset(nil)
 			t.persistentFlateReader = fr
 			// override Get/Put to use persistent reader and avoid putting it back
 			t.reader.GetFlateReader = func(reader io.Reader) *wsutils.FlateReader {
-				t.persistentFlateReader.Reset(reader)
-				return t.persistentFlateReader
+				fr.Reset(reader)
+				return fr
 			}
 			t.reader.PutFlateReader = func(reader *wsutils.FlateReader) {
 				// no-op: do not return persistent reader to pool now
 			}
 		}
 
-		// For writer side: if we are allowed to keep context takeover for our
-		// outgoing messages, create persistent writer to reuse; otherwise use pool per message.
-		ourNoCtx := false
-		if t.state.ServerSide() {
-			// we are server => our side corresponds to server params
-			ourNoCtx = t.negotiated.serverNoContextTake
-		} else {
-			ourNoCtx = t.negotiated.clientNoContextTake
+		// For writer side: a negotiated max window bits for our side needs a
+		// writer of our own, klauspost's flate writer supports the requested
+		// window size. Otherwise keep a persistent writer if we are allowed
+		// to keep context takeover, or use the pool per message.
+		if windowBits := t.localWindowBits(); windowBits > 0 {
+			windowSize := 1 << uint(windowBits)
+			t.persistentFlateWriter = wsutils.NewFlateWriter(nil, func(w io.Writer) wsflate.Compressor {
+				wp, _ := kpflate.NewWriterWindow(w, windowSize)
+				return wp
+			})
+		} else if !t.localNoContextTakeover() {
+			fw := t.options.flateWriterPool.Get().(*wsutils.FlateWriter)
+			fw.Reset(nil)
+			t.persistentFlateWriter = fw
 		}
-		if !ourNoCtx {
-			// create persistent writer
-			// If negotiated max window bits for our side is present, use
-			// klauspost's flate writer with the requested window size.
-			ourWindowBits := 0
-			if t.state.ServerSide() {
-				ourWindowBits = t.negotiated.serverMaxWindowBits
-			} else {
-				ourWindowBits = t.negotiated.clientMaxWindowBits
-			}
 
-			if ourWindowBits > 0 {
-				windowSize := 1 << uint(ourWindowBits)
-				fw := wsutils.NewFlateWriter(nil, func(w io.Writer) wsflate.Compressor {
-					wp, _ := kpflate.NewWriterWindow(w, windowSize)
-					return wp
-				})
-				t.persistentFlateWriter = fw
-			} else {
-				fw := t.options.flateWriterPool.Get().(*wsutils.FlateWriter)
-				fw.Reset(nil)
-				t.persistentFlateWriter = fw
-			}
+		if nil != t.persistentFlateWriter {
+			t.persistentFlateWriter.SetContextTakeover(!t.localNoContextTakeover())
 		}
 	}
 
+	if nil != t.keepalive {
+		t.keepalive.start()
+	}
+
 	return t, nil
 }
 
+// localNoContextTakeover reports whether our compressed messages must not refer
+// to the previous ones.
+func (t *websocketTransport) localNoContextTakeover() bool {
+	if t.state.ServerSide() {
+		return t.negotiated.serverNoContextTake
+	}
+	return t.negotiated.clientNoContextTake
+}
+
+// localWindowBits returns the negotiated max window bits of our compressed
+// messages, 0 if not limited.
+func (t *websocketTransport) localWindowBits() int {
+	if t.state.ServerSide() {
+		return t.negotiated.serverMaxWindowBits
+	}
+	return t.negotiated.clientMaxWindowBits
+}
+
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	switch t := conn.(type) {
+	case *net.TCPConn:
+		return t.SetNoDelay(noDelay)
+	case *tls.Conn:
+		return setNoDelay(t.NetConn(), noDelay)
+	case *bufferedConn:
+		return setNoDelay(t.Conn, noDelay)
+	}
+	return nil
+}
+
+func connectionState(conn net.Conn) *tls.ConnectionState {
+	switch t := conn.(type) {
+	case *tls.Conn:
+		state := t.ConnectionState()
+		return &state
+	case *bufferedConn:
+		return connectionState(t.Conn)
+	case *streamConn:
+		return t.tlsState
+	}
+	return nil
+}
+
 func (t *websocketTransport) Route() string {
 	return t.request.URL.Path
 }
 
 func (t *websocketTransport) Header() http.Header {
+	if nil != t.response {
+		// client side
+		return t.response.Header
+	}
 	return t.request.Header
 }
 
@@ -197,6 +351,10 @@ func (t *websocketTransport) Request() *http.Request {
 	return t.request
 }
 
+func (t *websocketTransport) TLS() *tls.ConnectionState {
+	return t.tlsState
+}
+
 // Read implements io.Reader. It reads the next message payload into p.
 // It takes care on fragmented messages.
 //
@@ -206,7 +364,26 @@ func (t *websocketTransport) Request() *http.Request {
 //
 // The error is ErrNoFrameAdvance if no NextFrame() call was made before
 // reading next message bytes.
+//
+// The error is a CloseError if the peer closed the connection, and
+// ErrMessageTooBig or wsutil.ErrFrameTooLarge if a size limit was exceeded,
+// the connection is closed with status 1009 (Message Too Big) then.
 func (t *websocketTransport) Read(p []byte) (int, error) {
+	n, err := t.read(p)
+	if nil != err && io.EOF != err {
+		if errors.Is(err, ErrMessageTooBig) || errors.Is(err, wsutil.ErrFrameTooLarge) {
+			t.abort(ws.StatusMessageTooBig, "message too big")
+		}
+		err = wrapCloseError(err)
+		if nil != t.closeTimer.Load() && IsCloseError(err) {
+			// the peer answered GracefulClose
+			_ = t.Close()
+		}
+	}
+	return n, err
+}
+
+func (t *websocketTransport) read(p []byte) (int, error) {
 
 	if nil == t.msgReader {
 		for {
@@ -239,6 +416,7 @@ func (t *websocketTransport) Read(p []byte) (int, error) {
 				continue
 			}
 
+			t.msgOpCode = hdr.OpCode
 			t.msgReader = t.reader
 			break
 		}
@@ -253,10 +431,30 @@ func (t *websocketTransport) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// MessageOpCode returns the opcode (OpText or OpBinary) of the inbound message
+// currently being read, it keeps the value until the next message begins.
+func (t *websocketTransport) MessageOpCode() ws.OpCode {
+	return t.msgOpCode
+}
+
+// Write writes p as a single message with the opcode selected by Options.OpCode.
 func (t *websocketTransport) Write(p []byte) (n int, err error) {
+	return t.writeMessage(t.opCode, p)
+}
+
+// WriteMessage writes p as a single message with the given opcode, which must be
+// OpText or OpBinary.
+func (t *websocketTransport) WriteMessage(opCode ws.OpCode, p []byte) (n int, err error) {
+	if ws.OpText != opCode && ws.OpBinary != opCode {
+		return 0, ErrUnsupportedOpCode
+	}
+	return t.writeMessage(opCode, p)
+}
+
+func (t *websocketTransport) writeMessage(opCode ws.OpCode, p []byte) (n int, err error) {
 
 	if compressed := t.options.CompressEnabled && t.negotiated.enabled && int64(len(p)) >= t.options.CompressThreshold; compressed {
-		return t.writeCompress(p)
+		return t.writeCompress(opCode, p)
 	}
 
 	packetBuffers := pbytes.Get(ws.MaxHeaderSize + len(p))
@@ -266,27 +464,28 @@ func (t *websocketTransport) Write(p []byte) (n int, err error) {
 	var dataSize = len(p)
 	var mask [4]byte
 
-	// xor bytes if client side
+	// mask key if client side
 	if t.state.ClientSide() {
 		binary.BigEndian.PutUint32(mask[:], rand.Uint32())
-		wsutils.FastCipher(p, mask, 0)
 	}
 
 	// pack websocket header
-	var hn, e = t.packHeader((*packetBuffers)[:ws.MaxHeaderSize], true, mask, int64(dataSize), false)
+	var hn, e = t.packHeader((*packetBuffers)[:ws.MaxHeaderSize], opCode, true, mask, int64(dataSize), false)
 	// pack header failed
 	if nil != e {
 		return 0, e
 	}
 
 	// copy payload
-	hn += copy((*packetBuffers)[hn:hn+len(p)], p)
+	hn += t.copyPayload((*packetBuffers)[hn:hn+len(p)], p, mask, 0)
 
+	t.messageLocker.Lock()
+	defer t.messageLocker.Unlock()
 	t.writeLocker.Lock()
 	defer t.writeLocker.Unlock()
 
 	// write websocket frame
-	if _, err = t.Transport.Write((*packetBuffers)[:hn]); nil == err {
+	if err = t.writeFrames((*packetBuffers)[:hn]); nil == err {
 		// return data-size
 		n = dataSize
 	}
@@ -294,68 +493,34 @@ func (t *websocketTransport) Write(p []byte) (n int, err error) {
 	return
 }
 
-func (t *websocketTransport) writeCompress(p []byte) (n int, err error) {
+func (t *websocketTransport) writeCompress(opCode ws.OpCode, p []byte) (n int, err error) {
 
-	var payloadBuffer *bytes.Buffer
-	var flateWriter *wsutils.FlateWriter
-	defer func() {
-		if nil != payloadBuffer {
-			pbuffer.Put(payloadBuffer)
-		}
+	// messages are compressed in the order they are sent, a writer with
+	// context takeover refers to the previous ones.
+	t.messageLocker.Lock()
+	defer t.messageLocker.Unlock()
 
-		// if writer is persistent, do not put it back here; persistent writer
-		// kept in t.persistentFlateWriter and will be returned on Close.
-		if nil != flateWriter && flateWriter != t.persistentFlateWriter {
-			flateWriter.Reset(nil)
-			t.options.flateWriterPool.Put(flateWriter)
-		}
-	}()
-
-	// raw payload length
-	var dataSize = len(p)
-
-	// raw payload length
-	var payloadLength = int64(dataSize)
-	var compressed bool
+	payloadBuffer := pbuffer.Get(len(p))
+	defer pbuffer.Put(payloadBuffer)
 
 	// payload compression
-	if compressed = t.options.CompressEnabled && payloadLength >= t.options.CompressThreshold; compressed {
-		payloadBuffer = pbuffer.Get(int(payloadLength))
-
-		if t.persistentFlateWriter != nil {
-			flateWriter = t.persistentFlateWriter
-			flateWriter.Reset(payloadBuffer)
-		} else {
-			flateWriter = t.options.flateWriterPool.Get().(*wsutils.FlateWriter)
-			flateWriter.Reset(payloadBuffer)
-		}
-
-		if _, err = flateWriter.Write(p); nil == err {
-			err = flateWriter.Flush()
-		}
-		// compressed length
-		payloadLength = int64(payloadBuffer.Len())
-		// compressed data
-		p = payloadBuffer.Bytes()
-	}
-
-	// If compression failed, return the error
-	if err != nil {
+	if err = t.compress(payloadBuffer, p); nil != err {
 		return 0, err
 	}
 
+	// compressed data
+	var payload = payloadBuffer.Bytes()
 	var mask [4]byte
-	// xor bytes if client side
+	// mask key if client side
 	if t.state.ClientSide() {
 		binary.BigEndian.PutUint32(mask[:], rand.Uint32())
-		wsutils.FastCipher(p, mask, 0)
 	}
 
-	packetBuffers := pbytes.Get(ws.MaxHeaderSize + len(p))
+	packetBuffers := pbytes.Get(ws.MaxHeaderSize + len(payload))
 	defer pbytes.Put(packetBuffers)
 
 	// pack websocket header
-	var hn, e = t.packHeader((*packetBuffers)[:ws.MaxHeaderSize], true, mask, payloadLength, compressed)
+	var hn, e = t.packHeader((*packetBuffers)[:ws.MaxHeaderSize], opCode, true, mask, int64(len(payload)), true)
 
 	// pack header failed
 	if nil != e {
@@ -363,33 +528,167 @@ func (t *websocketTransport) writeCompress(p []byte) (n int, err error) {
 	}
 
 	// copy payload
-	hn += copy((*packetBuffers)[hn:hn+len(p)], p)
+	hn += t.copyPayload((*packetBuffers)[hn:hn+len(payload)], payload, mask, 0)
 
 	t.writeLocker.Lock()
 	defer t.writeLocker.Unlock()
 
 	// write websocket frame
-	if _, err = t.Transport.Write((*packetBuffers)[:hn]); nil == err {
+	if err = t.writeFrames((*packetBuffers)[:hn]); nil == err {
 		// return data-size
-		n = dataSize
+		n = len(p)
 	}
 	return
 }
 
+// compress deflates buffs into dst as the payload of one message, with the
+// persistent flate writer if context takeover is in use.
+func (t *websocketTransport) compress(dst *bytes.Buffer, buffs ...[]byte) (err error) {
+
+	flateWriter := t.persistentFlateWriter
+	if nil == flateWriter {
+		flateWriter = t.options.flateWriterPool.Get().(*wsutils.FlateWriter)
+		defer func() {
+			flateWriter.Reset(nil)
+			t.options.flateWriterPool.Put(flateWriter)
+		}()
+	}
+
+	flateWriter.Reset(dst)
+	for _, p := range buffs {
+		if _, err = flateWriter.Write(p); nil != err {
+			return err
+		}
+	}
+	return flateWriter.Flush()
+}
+
+// copyPayload copies p into dst, xoring it with mask on the client side so
+// the caller's slice is left untouched. off is the position of p in the
+// frame payload.
+func (t *websocketTransport) copyPayload(dst, p []byte, mask [4]byte, off int) int {
+	if t.state.ClientSide() {
+		wsutils.CipherCopy(dst, p, mask, off)
+		return len(p)
+	}
+	return copy(dst, p)
+}
+
+// Writev writes the buffers as a single message with the opcode selected by
+// Options.OpCode. A message larger than Options.FragmentSize is split into
+// continuation frames, all frames are written to the connection at once.
 func (t *websocketTransport) Writev(buffs transport.Buffers) (int64, error) {
 
-	var writeSize int64
+	var dataSize int
 	for _, pkt := range buffs {
-		if _, err := t.Write(pkt); nil != err {
+		dataSize += len(pkt)
+	}
+
+	// messages are compressed and framed in the order they are sent
+	t.messageLocker.Lock()
+	defer t.messageLocker.Unlock()
+
+	var payload, compressed = [][]byte(buffs), false
+	if t.options.CompressEnabled && t.negotiated.enabled && int64(dataSize) >= t.options.CompressThreshold {
+		payloadBuffer := pbuffer.Get(dataSize)
+		defer pbuffer.Put(payloadBuffer)
+
+		if err := t.compress(payloadBuffer, buffs...); nil != err {
 			return 0, err
 		}
-		writeSize += int64(len(pkt))
+		payload, compressed = [][]byte{payloadBuffer.Bytes()}, true
 	}
 
-	return writeSize, nil
+	if err := t.writeFragments(t.opCode, compressed, payload); nil != err {
+		return 0, err
+	}
+	return int64(dataSize), nil
 }
 
+// writeFragments packs payload as the frames of one message and writes them
+// with a single write.
+func (t *websocketTransport) writeFragments(opCode ws.OpCode, compressed bool, payload [][]byte) error {
+
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+
+	fragmentSize := t.options.FragmentSize
+	if fragmentSize <= 0 {
+		fragmentSize = defaultFragmentSize
+	}
+
+	frames := (size + fragmentSize - 1) / fragmentSize
+	if 0 == frames {
+		// empty message
+		frames = 1
+	}
+
+	packetBuffers := pbytes.Get(frames*ws.MaxHeaderSize + size)
+	defer pbytes.Put(packetBuffers)
+	packet := (*packetBuffers)[:cap(*packetBuffers)]
+
+	var n, index, pos int
+	var mask [4]byte
+	for remaining, first := size, true; first || remaining > 0; first = false {
+		length := remaining
+		if length > fragmentSize {
+			length = fragmentSize
+		}
+		remaining -= length
+
+		// mask key if client side
+		if t.state.ClientSide() {
+			binary.BigEndian.PutUint32(mask[:], rand.Uint32())
+		}
+
+		// only the first frame of a compressed message has RSV1 set
+		hn, err := t.packHeader(packet[n:n+ws.MaxHeaderSize], opCode, 0 == remaining, mask, int64(length), compressed && first)
+		if nil != err {
+			return err
+		}
+		n += hn
+
+		// copy the frame payload, it may span several buffers
+		for off := 0; off < length; {
+			src := payload[index][pos:]
+			if len(src) > length-off {
+				src = src[:length-off]
+			}
+			n += t.copyPayload(packet[n:n+len(src)], src, mask, off)
+			off += len(src)
+
+			if pos += len(src); pos == len(payload[index]) {
+				index, pos = index+1, 0
+			}
+		}
+
+		opCode = ws.OpContinuation
+	}
+
+	t.writeLocker.Lock()
+	defer t.writeLocker.Unlock()
+	return t.writeFrames(packet[:n])
+}
+
+// writeFrames writes the frames of a whole data message, the queued messages
+// may be dropped by Options.WriteQueuePolicy. The writeLocker must be held.
+func (t *websocketTransport) writeFrames(frames []byte) error {
+	if nil != t.queue {
+		return t.queue.writeMessage(frames)
+	}
+	_, err := t.Transport.Write(frames)
+	return err
+}
+
+// WriteClose sends a close frame with the given code and reason, it does nothing
+// if a close frame has already been sent.
 func (t *websocketTransport) WriteClose(code int, reason string) (err error) {
+	if !t.closeSent.CompareAndSwap(false, true) {
+		return nil
+	}
+
 	closeFrame := ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusCode(code), reason))
 
 	// xor bytes if client side
@@ -413,24 +712,45 @@ func (t *websocketTransport) Flush() error {
 	return t.Transport.Flush()
 }
 
-// Close closes the underlying transport and releases any persistent flate
-// instances back to pools.
+// onRelease adds a hook called once when the transport is closed, hooks must be
+// added before the transport is handed out.
+func (t *websocketTransport) onRelease(hook func()) {
+	t.releaseHooks = append(t.releaseHooks, hook)
+}
+
+// Close closes the underlying transport and releases the persistent flate
+// writer back to its pool.
 func (t *websocketTransport) Close() error {
-	// release persistent flate reader
-	if t.persistentFlateReader != nil {
-		t.persistentFlateReader.Reset(nil)
-		t.options.flateReaderPool.Put(t.persistentFlateReader)
-		t.persistentFlateReader = nil
+	if timer := t.closeTimer.Load(); nil != timer {
+		timer.Stop()
+	}
+	if nil != t.keepalive {
+		t.keepalive.stop()
 	}
-	if t.persistentFlateWriter != nil {
+	t.releaseOnce.Do(func() {
+		for _, hook := range t.releaseHooks {
+			hook()
+		}
+	})
+	// the persistent flate reader is owned by the read path, which may still be
+	// inflating a message when Close is called from another goroutine, so it is
+	// left to the garbage collector instead of being put back to the pool.
+
+	// release persistent flate writer unless a message is being written
+	if t.persistentFlateWriter != nil && t.messageLocker.TryLock() {
+		t.persistentFlateWriter.SetContextTakeover(false)
 		t.persistentFlateWriter.Reset(nil)
-		t.options.flateWriterPool.Put(t.persistentFlateWriter)
+		// writers with a custom window are not pooled
+		if 0 == t.localWindowBits() {
+			t.options.flateWriterPool.Put(t.persistentFlateWriter)
+		}
 		t.persistentFlateWriter = nil
+		t.messageLocker.Unlock()
 	}
 	return t.Transport.Close()
 }
 
-func (t *websocketTransport) packHeader(bts []byte, fin bool, mask [4]byte, length int64, compressed bool) (n int, err error) {
+func (t *websocketTransport) packHeader(bts []byte, opCode ws.OpCode, fin bool, mask [4]byte, length int64, compressed bool) (n int, err error) {
 	const (
 		bit0  = 0x80
 		bit1  = 0x40
@@ -439,7 +759,7 @@ func (t *websocketTransport) packHeader(bts []byte, fin bool, mask [4]byte, leng
 		len64 = int64(^(uint64(0)) >> 1)
 	)
 
-	bts[0] = byte(t.opCode)
+	bts[0] = byte(opCode)
 
 	if fin {
 		bts[0] |= bit0
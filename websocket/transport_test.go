@@ -42,13 +42,21 @@ func TestParsePerMessageDeflate(t *testing.T) {
 	}
 }
 
+// compressedOptions returns a copy of DefaultOptions with compression enabled.
+// Apply returns its receiver, so setting fields on DefaultOptions.Apply() would
+// change the shared defaults and leak compression into every later test.
+func compressedOptions() *Options {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	return opts.Apply()
+}
+
 func TestNewWebsocketTransport_PersistentWriterCreatedWithMaxWindowBits(t *testing.T) {
 	c1, c2 := net.Pipe()
 	defer c1.Close()
 	defer c2.Close()
 
-	wsOptions := DefaultOptions.Apply()
-	wsOptions.CompressEnabled = true
+	wsOptions := compressedOptions()
 
 	// Prepare handshake with permessage-deflate and server_max_window_bits=9
 	hs := ws.Handshake{
@@ -74,8 +82,7 @@ func TestNewWebsocketTransport_PersistentReaderCreatedWhenContextTakeoverAllowed
 	defer c1.Close()
 	defer c2.Close()
 
-	wsOptions := DefaultOptions.Apply()
-	wsOptions.CompressEnabled = true
+	wsOptions := compressedOptions()
 
 	// Prepare handshake with permessage-deflate, no no_context_takeover flags
 	hs := ws.Handshake{
@@ -99,8 +106,7 @@ func TestNewWebsocketTransport_NoPersistentWriterWhenNoContextTakeover(t *testin
 	defer c1.Close()
 	defer c2.Close()
 
-	wsOptions := DefaultOptions.Apply()
-	wsOptions.CompressEnabled = true
+	wsOptions := compressedOptions()
 
 	// Prepare handshake with permessage-deflate and server_no_context_takeover
 	hs := ws.Handshake{
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Websockets on unix sockets use the ws+unix and wss+unix schemes, the path of
+// the URL holds the socket path and the route separated by a colon:
+//
+//	ws+unix:///var/run/agent.sock:/ws?token=...
+//	ws+unix:///@agent:/ws (abstract namespace on Linux)
+//
+// The route defaults to "/", socket paths can't contain a colon.
+
+const unixSchemeSuffix = "+unix"
+
+// unixHost is the Host of the handshake requests sent on unix sockets.
+const unixHost = "localhost"
+
+var errUnixStream = errors.New("websocket: HTTP/2 and HTTP/3 are not dialed on unix sockets")
+
+// splitUnixScheme returns the websocket scheme of scheme and whether it is on a
+// unix socket.
+func splitUnixScheme(scheme string) (string, bool) {
+	return strings.CutSuffix(scheme, unixSchemeSuffix)
+}
+
+// unixAddress returns the socket and the route of a ws+unix or wss+unix URL.
+func unixAddress(u *url.URL) (socket, route string) {
+	socket, route, found := strings.Cut(u.Path, ":")
+	if !found || "" == route {
+		route = "/"
+	}
+	if strings.HasPrefix(socket, "/@") {
+		// abstract sockets are named with a leading @
+		socket = socket[1:]
+	}
+	return socket, route
+}
+
+// unixDial dials the socket whatever the address of the handshake request.
+func unixDial(socket string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+}
@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-netty/go-netty/transport"
+)
+
+func listenUnix(t *testing.T, address string, opts *Options) *wsAcceptor {
+	options, err := transport.ParseOptions(context.Background(), address, WithOptions(opts))
+	if err != nil {
+		t.Fatalf("parse options error: %v", err)
+	}
+	acceptor, err := New().Listen(options)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { _ = acceptor.Close() })
+	return acceptor.(*wsAcceptor)
+}
+
+func testUnixRoundTrip(t *testing.T, address string) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	opts.CompressThreshold = 0
+	acceptor := listenUnix(t, address, &opts)
+
+	client, err := connectWebsocket(t, address+"?id=1", &opts)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	server, err := acceptor.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	defer server.Close()
+
+	if route := server.(Transport).Route(); route != "/ws" {
+		t.Fatalf("unexpected server route: %q", route)
+	}
+	if query := server.(Transport).Request().URL.RawQuery; query != "id=1" {
+		t.Fatalf("unexpected query: %q", query)
+	}
+	if client.Route() != "/ws" || !client.negotiated.enabled {
+		t.Fatalf("unexpected client route %q, compress %v", client.Route(), client.negotiated.enabled)
+	}
+
+	roundTrip(t, client, server.(Transport), "over unix socket")
+	roundTrip(t, server.(Transport), client, "reply")
+}
+
+func TestUnix_SocketPath(t *testing.T) {
+	testUnixRoundTrip(t, "ws+unix://"+filepath.Join(t.TempDir(), "ws.sock")+":/ws")
+}
+
+func TestUnix_AbstractNamespace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are Linux only")
+	}
+	testUnixRoundTrip(t, fmt.Sprintf("ws+unix:///@go-netty-ws-%d:/ws", time.Now().UnixNano()))
+}
+
+func TestUnixAddress(t *testing.T) {
+	for _, c := range []struct {
+		address, socket, route string
+	}{
+		{"ws+unix:///tmp/ws.sock:/chat", "/tmp/ws.sock", "/chat"},
+		{"ws+unix:///tmp/ws.sock", "/tmp/ws.sock", "/"},
+		{"wss+unix:///@agent:/a/b", "@agent", "/a/b"},
+	} {
+		u, err := url.Parse(c.address)
+		if err != nil {
+			t.Fatalf("parse %s error: %v", c.address, err)
+		}
+		if socket, route := unixAddress(u); socket != c.socket || route != c.route {
+			t.Fatalf("%s: unexpected socket %q, route %q", c.address, socket, route)
+		}
+	}
+}
@@ -2,13 +2,12 @@ package websocket
 
 import (
 	"context"
+	"net"
 	"net/http"
 
 	"github.com/go-netty/go-netty"
 	"github.com/go-netty/go-netty/transport"
-	"github.com/gobwas/httphead"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsflate"
 )
 
 type Upgrader interface {
@@ -35,15 +34,6 @@ func NewHTTPUpgrader(engine netty.Bootstrap, option ...transport.Option) HTTPUpg
 
 	wsOptions := FromContext(options.Context, DefaultOptions)
 
-	if wsOptions.CompressEnabled && nil == wsOptions.Upgrader.Negotiate {
-		wsOptions.Upgrader.Negotiate = func(option httphead.Option) (httphead.Option, error) {
-			e := wsflate.Extension{
-				Parameters: wsflate.DefaultParameters,
-			}
-			return e.Negotiate(option)
-		}
-	}
-
 	return HTTPUpgrader{
 		Upgrader:   wsOptions.Upgrader,
 		ctx:        options.Context,
@@ -53,9 +43,25 @@ func NewHTTPUpgrader(engine netty.Bootstrap, option ...transport.Option) HTTPUpg
 	}
 }
 
+// Upgrade serves the websocket channel of the request. An HTTP/2 stream ends
+// with its handler, so an extended CONNECT request returns once the channel is closed.
 func (hu HTTPUpgrader) Upgrade(writer http.ResponseWriter, request *http.Request) (netty.Channel, error) {
-	conn, _, hs, err := hu.Upgrader.Upgrade(request, writer)
+	resolveRemoteAddr(request, hu.options.trustedProxies)
+
+	upgrader, attachment, err := prepareUpgrade(hu.Upgrader, hu.options, writer, request)
 	if nil != err {
+		return nil, err
+	}
+
+	var conn net.Conn
+	var hs ws.Handshake
+	var stream *streamConn
+	if isExtendedConnect(request) {
+		if stream, hs, err = upgradeStream(upgrader, writer, request); nil != err {
+			return nil, err
+		}
+		conn = stream
+	} else if conn, _, hs, err = upgrader.Upgrade(request, writer); nil != err {
 		if nil != conn {
 			_ = conn.Close()
 		}
@@ -67,6 +73,15 @@ func (hu HTTPUpgrader) Upgrade(writer http.ResponseWriter, request *http.Request
 		_ = conn.Close()
 		return nil, err
 	}
+	t.attachment = attachment
+	if nil != hu.options.Registry {
+		hu.options.Registry.add(t)
+	}
 
-	return hu.serve.ServeChannel(hu.ctx, t, hu.attachment, true), nil
+	channel := hu.serve.ServeChannel(hu.ctx, t, hu.attachment, true)
+	if nil != stream {
+		// the stream ends when the handler returns
+		stream.wait(request.Context())
+	}
+	return channel, nil
 }
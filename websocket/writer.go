@@ -0,0 +1,218 @@
+/*
+ * Copyright 2019 the go-netty project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+
+	"github.com/go-netty/go-netty-transport/websocket/internal/wsutils"
+	"github.com/go-netty/go-netty/utils/pool/pbuffer"
+	"github.com/go-netty/go-netty/utils/pool/pbytes"
+	"github.com/gobwas/ws"
+)
+
+const defaultFragmentSize = 32 * 1024
+
+var (
+	// ErrUnsupportedOpCode returned when a data message is requested with a non text/binary opcode.
+	ErrUnsupportedOpCode = errors.New("websocket: unsupported message opcode")
+	// ErrWriterClosed returned when writing to a closed message writer.
+	ErrWriterClosed = errors.New("websocket: message writer closed")
+)
+
+// NextWriter returns a writer for the next data message, the message is sent as
+// a first frame of opCode followed by continuation frames of Options.FragmentSize
+// bytes as data is written, and finished by Close.
+//
+// When permessage-deflate is negotiated the message is compressed and every
+// fragment carries the flushed deflate output, so the peer can inflate it as it
+// arrives.
+//
+// Other data messages are blocked until the writer is closed, so the caller must
+// Close the writer before writing the next message.
+func (t *websocketTransport) NextWriter(opCode ws.OpCode) (io.WriteCloser, error) {
+
+	if ws.OpText != opCode && ws.OpBinary != opCode {
+		return nil, ErrUnsupportedOpCode
+	}
+
+	fragmentSize := t.options.FragmentSize
+	if fragmentSize <= 0 {
+		fragmentSize = defaultFragmentSize
+	}
+
+	t.messageLocker.Lock()
+
+	w := &messageWriter{
+		t:          t,
+		opCode:     opCode,
+		compressed: t.options.CompressEnabled && t.negotiated.enabled,
+		buffer:     pbytes.Get(fragmentSize),
+	}
+
+	if w.compressed {
+		w.payloadBuffer = pbuffer.Get(fragmentSize)
+		if w.flateWriter = t.persistentFlateWriter; nil == w.flateWriter {
+			w.flateWriter = t.options.flateWriterPool.Get().(*wsutils.FlateWriter)
+		}
+		w.flateWriter.Reset(w.payloadBuffer)
+	}
+
+	return w, nil
+}
+
+// messageWriter writes a data message as a sequence of fragments.
+type messageWriter struct {
+	t             *websocketTransport
+	opCode        ws.OpCode // opcode of the next fragment
+	compressed    bool
+	buffer        *[]byte // pending uncompressed bytes of the next fragment
+	n             int
+	payloadBuffer *bytes.Buffer
+	flateWriter   *wsutils.FlateWriter
+	err           error
+	closed        bool
+}
+
+func (w *messageWriter) Write(p []byte) (n int, err error) {
+
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+
+	if nil != w.err {
+		return 0, w.err
+	}
+
+	buffer := (*w.buffer)[:cap(*w.buffer)]
+	for len(p) > 0 {
+		if w.n == len(buffer) {
+			if err = w.flushFragment(false); nil != err {
+				return n, err
+			}
+		}
+
+		c := copy(buffer[w.n:], p)
+		w.n += c
+		n += c
+		p = p[c:]
+	}
+
+	return n, nil
+}
+
+// Close sends the final fragment of the message and releases the writer.
+func (w *messageWriter) Close() error {
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	w.closed = true
+	defer w.release()
+
+	if nil != w.err {
+		return w.err
+	}
+
+	return w.flushFragment(true)
+}
+
+func (w *messageWriter) flushFragment(fin bool) (err error) {
+
+	payload := (*w.buffer)[:w.n]
+
+	if w.compressed {
+		w.payloadBuffer.Reset()
+		if _, err = w.flateWriter.Write(payload); nil == err {
+			err = w.flateWriter.Flush()
+		}
+
+		if nil != err {
+			w.err = err
+			return err
+		}
+		payload = w.payloadBuffer.Bytes()
+	}
+
+	// only the first fragment of a compressed message has RSV1 set
+	first := ws.OpContinuation != w.opCode
+	if err = w.t.writeFrame(w.opCode, fin, w.compressed && first, payload); nil == err {
+		err = w.t.Flush()
+	}
+
+	w.opCode = ws.OpContinuation
+	w.n = 0
+	w.err = err
+	return err
+}
+
+func (w *messageWriter) release() {
+	if nil != w.buffer {
+		pbytes.Put(w.buffer)
+		w.buffer = nil
+	}
+
+	if nil != w.payloadBuffer {
+		pbuffer.Put(w.payloadBuffer)
+		w.payloadBuffer = nil
+	}
+
+	if nil != w.flateWriter && w.flateWriter != w.t.persistentFlateWriter {
+		w.flateWriter.Reset(nil)
+		w.t.options.flateWriterPool.Put(w.flateWriter)
+	}
+	w.flateWriter = nil
+
+	w.t.messageLocker.Unlock()
+}
+
+// writeFrame writes a single frame, the payload is masked while copied so the
+// caller's slice is left untouched.
+func (t *websocketTransport) writeFrame(opCode ws.OpCode, fin bool, compressed bool, payload []byte) error {
+
+	packetBuffers := pbytes.Get(ws.MaxHeaderSize + len(payload))
+	defer pbytes.Put(packetBuffers)
+
+	var mask [4]byte
+	if t.state.ClientSide() {
+		binary.BigEndian.PutUint32(mask[:], rand.Uint32())
+	}
+
+	// pack websocket header
+	hn, err := t.packHeader((*packetBuffers)[:ws.MaxHeaderSize], opCode, fin, mask, int64(len(payload)), compressed)
+	if nil != err {
+		return err
+	}
+
+	// copy payload, xor bytes if client side
+	frame := (*packetBuffers)[:hn+len(payload)]
+	t.copyPayload(frame[hn:], payload, mask, 0)
+
+	t.writeLocker.Lock()
+	defer t.writeLocker.Unlock()
+	if fin && opCode.IsData() {
+		// a data message of a single frame, pings and pongs are never dropped
+		return t.writeFrames(frame)
+	}
+	_, err = t.Transport.Write(frame)
+	return err
+}
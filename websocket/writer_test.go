@@ -0,0 +1,271 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-netty/go-netty/transport"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+func newTransportPair(t *testing.T, opts *Options, hs ws.Handshake) (client, server *websocketTransport) {
+	return newTransportPairWith(t, opts, opts, hs)
+}
+
+func newTransportPairWith(t *testing.T, clientOpts, serverOpts *Options, hs ws.Handshake) (client, server *websocketTransport) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+
+	req := &http.Request{Method: "GET", Header: http.Header{}}
+	client, err := newWebsocketTransport(c1, clientOpts, true, req, hs)
+	if err != nil {
+		t.Fatalf("newWebsocketTransport client error: %v", err)
+	}
+	server, err = newWebsocketTransport(c2, serverOpts, false, req, hs)
+	if err != nil {
+		t.Fatalf("newWebsocketTransport server error: %v", err)
+	}
+	return client, server
+}
+
+func testStreamingWriter(t *testing.T, opts *Options, hs ws.Handshake) {
+	client, server := newTransportPair(t, opts, hs)
+
+	payload := bytes.Repeat([]byte("streaming-fragmented-message;"), 1024)
+	writeErr := make(chan error, 1)
+	go func() {
+		w, err := client.NextWriter(ws.OpText)
+		if err != nil {
+			writeErr <- err
+			return
+		}
+		// write in odd sized chunks to cross fragment boundaries
+		for p := payload; len(p) > 0; {
+			n := 1000
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err = w.Write(p[:n]); err != nil {
+				writeErr <- err
+				return
+			}
+			p = p[n:]
+		}
+		writeErr <- w.Close()
+	}()
+
+	var got bytes.Buffer
+	buf := make([]byte, 512)
+	for {
+		n, err := server.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("server read error: %v", err)
+		}
+	}
+
+	if err := <-writeErr; err != nil {
+		t.Fatalf("client write error: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), payload) {
+		t.Fatalf("unexpected payload: got %d bytes, want %d bytes", got.Len(), len(payload))
+	}
+}
+
+func TestNextWriter_Fragmented(t *testing.T) {
+	opts := *DefaultOptions
+	opts.FragmentSize = 4096
+	testStreamingWriter(t, opts.Apply(), ws.Handshake{})
+}
+
+func TestNextWriter_FragmentedCompressed(t *testing.T) {
+	opts := *DefaultOptions
+	opts.FragmentSize = 4096
+	opts.CompressEnabled = true
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+	testStreamingWriter(t, opts.Apply(), hs)
+}
+
+func TestNextWriter_UnsupportedOpCode(t *testing.T) {
+	client, _ := newTransportPair(t, DefaultOptions, ws.Handshake{})
+	if _, err := client.NextWriter(ws.OpPing); err != ErrUnsupportedOpCode {
+		t.Fatalf("expected ErrUnsupportedOpCode, got: %v", err)
+	}
+}
+
+func TestRead_CompressedMessageLargerThanReadBuffer(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	opts.CompressThreshold = 1
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+	client, server := newTransportPair(t, opts.Apply(), hs)
+
+	// highly compressible payload inflates far beyond a single read
+	payload := bytes.Repeat([]byte("a"), 64*1024)
+	go func() { _, _ = client.Write(append([]byte(nil), payload...)) }()
+
+	got, err := io.ReadAll(readerFunc(server.Read))
+	if err != nil {
+		t.Fatalf("server read error: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("unexpected payload: got %d bytes, want %d bytes", len(got), len(payload))
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestClientWrite_LeavesPayloadUntouched(t *testing.T) {
+	client, server := newTransportPair(t, DefaultOptions, ws.Handshake{})
+
+	payload := []byte("caller-owned-buffer;caller-owned-buffer;")
+	original := append([]byte(nil), payload...)
+
+	// the server only accepts text messages (DefaultOptions.OpCode)
+	writes := []func() error{
+		func() error {
+			if _, err := client.Write(payload); err != nil {
+				return err
+			}
+			return client.Flush()
+		},
+		func() error {
+			if _, err := client.WriteMessage(ws.OpText, payload); err != nil {
+				return err
+			}
+			return client.Flush()
+		},
+		func() error {
+			if _, err := client.Writev(transport.Buffers{payload[:10], payload[10:]}); err != nil {
+				return err
+			}
+			return client.Flush()
+		},
+		func() error {
+			w, err := client.NextWriter(ws.OpText)
+			if err == nil {
+				_, err = w.Write(payload)
+			}
+			if err == nil {
+				err = w.Close()
+			}
+			return err
+		},
+	}
+
+	for i, write := range writes {
+		go func() { _ = write() }()
+
+		got, err := io.ReadAll(readerFunc(server.Read))
+		if err != nil {
+			t.Fatalf("write %d: read error: %v", i, err)
+		}
+		if !bytes.Equal(got, original) || !bytes.Equal(payload, original) {
+			t.Fatalf("write %d: caller's payload was modified: %q", i, payload)
+		}
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func TestWritev_SingleFragmentedMessage(t *testing.T) {
+	opts := *DefaultOptions
+	opts.FragmentSize = 16
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &countingConn{Conn: c1}
+	client, err := newWebsocketTransport(conn, opts.Apply(), true, &http.Request{Header: http.Header{}}, ws.Handshake{})
+	if err != nil {
+		t.Fatalf("newWebsocketTransport error: %v", err)
+	}
+
+	// a length header followed by the body, as written by a codec
+	buffs := transport.Buffers{[]byte("0050"), bytes.Repeat([]byte("body;"), 10)}
+	want := bytes.Join(buffs, nil)
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := client.Writev(buffs)
+		writeErr <- err
+	}()
+
+	var got []byte
+	for i := 0; ; i++ {
+		frame, err := ws.ReadFrame(c2)
+		if err != nil {
+			t.Fatalf("frame %d: read error: %v", i, err)
+		}
+		wantOpCode := ws.OpContinuation
+		if 0 == i {
+			wantOpCode = ws.OpText
+		}
+		if frame.Header.OpCode != wantOpCode || frame.Header.Length > 16 {
+			t.Fatalf("frame %d: unexpected header: %+v", i, frame.Header)
+		}
+		got = append(got, ws.UnmaskFrameInPlace(frame).Payload...)
+		if frame.Header.Fin {
+			break
+		}
+	}
+
+	if err := <-writeErr; err != nil {
+		t.Fatalf("writev error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected payload: %q", got)
+	}
+	if writes := conn.writes.Load(); writes != 1 {
+		t.Fatalf("expected frames to be written at once, got %d writes", writes)
+	}
+}
+
+func TestWritev_Compressed(t *testing.T) {
+	opts := *DefaultOptions
+	opts.CompressEnabled = true
+	opts.CompressThreshold = 1
+	opts.FragmentSize = 64
+	hs := ws.Handshake{
+		Extensions: []httphead.Option{(wsflate.Parameters{}).Option()},
+	}
+	client, server := newTransportPair(t, opts.Apply(), hs)
+
+	for i := 0; i < 3; i++ {
+		buffs := transport.Buffers{[]byte("header;"), bytes.Repeat([]byte("compressed-body;"), 64), nil}
+		go func() { _, _ = client.Writev(buffs) }()
+
+		got, err := io.ReadAll(readerFunc(server.Read))
+		if err != nil {
+			t.Fatalf("message %d: read error: %v", i, err)
+		}
+		if !bytes.Equal(got, bytes.Join(buffs, nil)) {
+			t.Fatalf("message %d: unexpected payload: got %d bytes", i, len(got))
+		}
+	}
+}